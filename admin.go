@@ -0,0 +1,541 @@
+package main
+
+import (
+	"context"
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"log/slog"
+	"net"
+	"net/http"
+	"sort"
+	"strconv"
+	"time"
+)
+
+type adminSession struct {
+	Tunnel    string `json:"tunnel,omitempty"`
+	ID        dgSes  `json:"id"`
+	Peer      string `json:"peer,omitempty"`
+	Target    string `json:"target,omitempty"`
+	Direct    bool   `json:"direct"`
+	Age       int    `json:"age"`
+	Idle      int    `json:"idle"`
+	InBytes   int    `json:"inBytes"`
+	OutBytes  int    `json:"outBytes"`
+	Fragments int    `json:"fragments"`
+}
+
+type adminHealth struct {
+	Tunnel   string `json:"tunnel,omitempty"`
+	Name     string `json:"name"`
+	Disabled bool   `json:"disabled"`
+	health
+}
+
+type adminMethod struct {
+	Name          string `json:"name"`
+	Enabled       bool   `json:"enabled"`
+	MaxLenPayload int    `json:"maxLenPayload"`
+	health
+}
+
+type adminStats struct {
+	Uptime   int `json:"uptime"`
+	Sessions int `json:"sessions"`
+	InBytes  int `json:"inBytes"`
+	OutBytes int `json:"outBytes"`
+}
+
+type adminReload struct {
+	Clubs int `json:"clubs"`
+	Users int `json:"users"`
+}
+
+type adminKey struct {
+	Tunnel    string `json:"tunnel,omitempty"`
+	ID        int    `json:"id"`
+	Active    bool   `json:"active"`
+	Accepted  bool   `json:"accepted"`
+	GraceLeft int    `json:"graceLeft"`
+}
+
+type adminCleanup struct {
+	InactiveSessions int `json:"inactiveSessions"`
+	ClosedSessions   int `json:"closedSessions"`
+	ClosedQueues     int `json:"closedQueues"`
+	ExpiredDNS       int `json:"expiredDNS"`
+}
+
+var startedAt = time.Now()
+
+func listenAdmin(ctx context.Context, cfg config) error {
+	addr := address{cfg.Admin.Host, cfg.Admin.Port}.String()
+	ln, err := net.Listen("tcp", addr)
+
+	if err != nil {
+		return err
+	}
+
+	mux := http.NewServeMux()
+
+	mux.HandleFunc("GET /stats", handleAdminStats)
+	mux.HandleFunc("GET /sessions", handleAdminSessions)
+	mux.HandleFunc("POST /sessions/{id}/close", handleAdminSessionClose)
+	mux.HandleFunc("GET /clubs", func(w http.ResponseWriter, r *http.Request) {
+		if list, ok := adminTunnels(w, r); ok {
+			writeAdmin(w, http.StatusOK, listAdminHealth(tunnelClubKeys(list), clubsHealth, clubsDisabled))
+		}
+	})
+	mux.HandleFunc("POST /clubs/{name}/{action}", func(w http.ResponseWriter, r *http.Request) {
+		if list, ok := adminTunnels(w, r); ok {
+			handleAdminDisable(w, r, tunnelClubKeys(list), clubsDisabled, setClubDisabled)
+		}
+	})
+	mux.HandleFunc("GET /users", func(w http.ResponseWriter, r *http.Request) {
+		if list, ok := adminTunnels(w, r); ok {
+			writeAdmin(w, http.StatusOK, listAdminHealth(tunnelUserKeys(list), usersHealth, usersDisabled))
+		}
+	})
+	mux.HandleFunc("POST /users/{name}/{action}", func(w http.ResponseWriter, r *http.Request) {
+		if list, ok := adminTunnels(w, r); ok {
+			handleAdminDisable(w, r, tunnelUserKeys(list), usersDisabled, setUserDisabled)
+		}
+	})
+	mux.HandleFunc("GET /methods", handleAdminMethods)
+	mux.HandleFunc("POST /cleanup", handleAdminCleanup)
+	mux.HandleFunc("POST /reload", handleAdminReload)
+	mux.HandleFunc("GET /keys", func(w http.ResponseWriter, r *http.Request) {
+		if list, ok := adminTunnels(w, r); ok {
+			writeAdmin(w, http.StatusOK, listAdminKeys(list))
+		}
+	})
+	mux.HandleFunc("POST /keys/{id}/promote", handleAdminKeyPromote)
+
+	srv := &http.Server{
+		Handler:           guardAdmin(cfg.Admin, mux),
+		ReadHeaderTimeout: 10 * time.Second,
+	}
+
+	go func() {
+		<-ctx.Done()
+		srv.Close()
+	}()
+
+	slog.Info("admin: listening", "addr", addr)
+
+	if err := srv.Serve(ln); err != nil && !errors.Is(err, http.ErrServerClosed) {
+		return err
+	}
+
+	return nil
+}
+
+// API is bound to loopback, so request with other Host is DNS rebinding,
+// and request with Origin is sent by browser from some web page.
+func guardAdmin(cfg configAdmin, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		host, _, err := net.SplitHostPort(r.Host)
+
+		if err != nil {
+			host = r.Host
+		}
+
+		if !isLoopbackHost(host) || len(r.Header.Get("Origin")) > 0 {
+			writeAdminError(w, http.StatusForbidden, "forbidden")
+			return
+		}
+
+		auth := []byte(r.Header.Get("Authorization"))
+
+		if len(cfg.Token) > 0 && subtle.ConstantTimeCompare(auth, []byte("Bearer "+cfg.Token)) != 1 {
+			writeAdminError(w, http.StatusUnauthorized, "unauthorized")
+			return
+		}
+
+		next.ServeHTTP(w, r)
+	})
+}
+
+// Requests without tunnel parameter apply to all tunnels.
+func adminTunnels(w http.ResponseWriter, r *http.Request) ([]*tunnel, bool) {
+	name := r.URL.Query().Get("tunnel")
+
+	if len(name) == 0 {
+		return tunnels, true
+	}
+
+	t, exists := findTunnel(name)
+
+	if !exists {
+		writeAdminError(w, http.StatusNotFound, "tunnel not found")
+		return nil, false
+	}
+
+	return []*tunnel{t}, true
+}
+
+func adminTunnel(w http.ResponseWriter, r *http.Request) (*tunnel, bool) {
+	list, ok := adminTunnels(w, r)
+
+	if !ok {
+		return nil, false
+	}
+
+	if len(list) != 1 {
+		writeAdminError(w, http.StatusBadRequest, "tunnel is required")
+		return nil, false
+	}
+
+	return list[0], true
+}
+
+func handleAdminStats(w http.ResponseWriter, r *http.Request) {
+	list, ok := adminTunnels(w, r)
+
+	if !ok {
+		return
+	}
+
+	stats := adminStats{
+		Uptime: int(time.Since(startedAt).Seconds()),
+	}
+
+	for _, t := range list {
+		stats.InBytes += int(metricBytes.value(t.name, "in"))
+		stats.OutBytes += int(metricBytes.value(t.name, "out"))
+
+		t.forEachSession(func(ses *session) {
+			stats.Sessions++
+		})
+	}
+
+	writeAdmin(w, http.StatusOK, stats)
+}
+
+func handleAdminSessions(w http.ResponseWriter, r *http.Request) {
+	selected, ok := adminTunnels(w, r)
+
+	if !ok {
+		return
+	}
+
+	list := []adminSession{}
+
+	for _, t := range selected {
+		t.forEachSession(func(ses *session) {
+			list = append(list, ses.admin())
+		})
+	}
+
+	sort.Slice(list, func(i, j int) bool {
+		if list[i].Tunnel != list[j].Tunnel {
+			return list[i].Tunnel < list[j].Tunnel
+		}
+
+		return list[i].ID < list[j].ID
+	})
+
+	writeAdmin(w, http.StatusOK, list)
+}
+
+func (s *session) admin() adminSession {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	info := adminSession{
+		Tunnel:    s.tunnel.name,
+		ID:        s.id,
+		Target:    s.target,
+		Direct:    s.direct,
+		Age:       int(time.Since(s.openedAt).Seconds()),
+		Idle:      int(time.Since(s.activity).Seconds()),
+		InBytes:   s.inBytes,
+		OutBytes:  s.outBytes,
+		Fragments: len(s.history),
+	}
+
+	if s.peer != nil {
+		info.Peer = s.peer.RemoteAddr().String()
+	}
+
+	return info
+}
+
+func handleAdminSessionClose(w http.ResponseWriter, r *http.Request) {
+	id, err := strconv.ParseInt(r.PathValue("id"), 10, 32)
+
+	if err != nil {
+		writeAdminError(w, http.StatusBadRequest, "invalid session id")
+		return
+	}
+
+	t, ok := adminTunnel(w, r)
+
+	if !ok {
+		return
+	}
+
+	ses, exists := t.getSession(dgSes(id))
+
+	if !exists || ses.isClosed() {
+		writeAdminError(w, http.StatusNotFound, "session not found")
+		return
+	}
+
+	t.logger().Info("admin: close session", "ses", ses)
+
+	if !ses.isDirect() {
+		ses.sendDatagram(newDatagram(t.device, 0, 0, commandClose, nil))
+	}
+
+	go ses.close()
+
+	writeAdmin(w, http.StatusOK, ses.admin())
+}
+
+// Without tunnel parameter the name is disabled in every tunnel that has it.
+func handleAdminDisable(w http.ResponseWriter, r *http.Request, keys []healthKey, disabled map[healthKey]bool, set func(healthKey, bool)) {
+	name := r.PathValue("name")
+	action := r.PathValue("action")
+	matched := []healthKey{}
+
+	for _, key := range keys {
+		if key.name == name {
+			matched = append(matched, key)
+		}
+	}
+
+	if len(matched) == 0 {
+		writeAdminError(w, http.StatusNotFound, "name not found")
+		return
+	}
+
+	if action != "disable" && action != "enable" {
+		writeAdminError(w, http.StatusNotFound, "unknown action")
+		return
+	}
+
+	if action == "disable" && !remainsEnabled(keys, matched, disabled) {
+		writeAdminError(w, http.StatusConflict, "last enabled name can't be disabled")
+		return
+	}
+
+	for _, key := range matched {
+		set(key, action == "disable")
+	}
+
+	slog.Info("admin: "+action, "path", r.URL.Path, "tunnel", r.URL.Query().Get("tunnel"))
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// Method is enabled if it's enabled in any tunnel.
+func handleAdminMethods(w http.ResponseWriter, r *http.Request) {
+	selected, ok := adminTunnels(w, r)
+
+	if !ok {
+		return
+	}
+
+	methods := []int{}
+
+	for method := range methodNames {
+		methods = append(methods, method)
+	}
+
+	sort.Ints(methods)
+
+	healthMu.Lock()
+	defer healthMu.Unlock()
+
+	list := []adminMethod{}
+
+	for _, method := range methods {
+		m := adminMethod{
+			Name: methodNames[method],
+		}
+
+		for _, t := range selected {
+			settings := t.loadMethods()
+			m.Enabled = m.Enabled || settings.enabled[method]
+			m.MaxLenPayload = max(m.MaxLenPayload, settings.maxLenPayload[method])
+		}
+
+		if h, exists := methodsHealth[method]; exists {
+			m.health = *h
+		}
+
+		list = append(list, m)
+	}
+
+	writeAdmin(w, http.StatusOK, list)
+}
+
+func handleAdminCleanup(w http.ResponseWriter, r *http.Request) {
+	list, ok := adminTunnels(w, r)
+
+	if !ok {
+		return
+	}
+
+	res := adminCleanup{}
+
+	for _, t := range list {
+		res.InactiveSessions += t.closeInactiveSessions()
+		res.ClosedSessions += t.deleteClosedSessions()
+		res.ClosedQueues += t.deleteClosedQueues()
+		res.ExpiredDNS += t.deleteExpiredDNSCache()
+	}
+
+	slog.Info("admin: cleanup", "inactive", res.InactiveSessions, "sessions", res.ClosedSessions, "queues", res.ClosedQueues, "dns", res.ExpiredDNS)
+
+	writeAdmin(w, http.StatusOK, res)
+}
+
+func handleAdminReload(w http.ResponseWriter, r *http.Request) {
+	slog.Info("admin: reload")
+
+	cfg, err := reloadConfig()
+
+	if err != nil {
+		slog.Error("admin: reload", "err", err)
+		writeAdminError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	clubs, users := countTunnels(cfg)
+
+	writeAdmin(w, http.StatusOK, adminReload{
+		Clubs: clubs,
+		Users: users,
+	})
+}
+
+func handleAdminKeyPromote(w http.ResponseWriter, r *http.Request) {
+	id, err := strconv.ParseUint(r.PathValue("id"), 10, 8)
+
+	if err != nil {
+		writeAdminError(w, http.StatusBadRequest, "invalid key id")
+		return
+	}
+
+	t, ok := adminTunnel(w, r)
+
+	if !ok {
+		return
+	}
+
+	if err := t.promoteKey(dgKey(id)); err != nil {
+		writeAdminError(w, http.StatusNotFound, err.Error())
+		return
+	}
+
+	t.logger().Info("admin: promote key", "key", id)
+
+	writeAdmin(w, http.StatusOK, listAdminKeys([]*tunnel{t}))
+}
+
+func listAdminKeys(selected []*tunnel) []adminKey {
+	list := []adminKey{}
+
+	for _, t := range selected {
+		ring := t.loadKeys()
+
+		for _, id := range ring.ids() {
+			list = append(list, adminKey{
+				Tunnel:    t.name,
+				ID:        int(id),
+				Active:    id == ring.active,
+				Accepted:  ring.isAccepted(id),
+				GraceLeft: int(ring.graceLeft(id).Seconds()),
+			})
+		}
+	}
+
+	return list
+}
+
+// Every tunnel must keep at least one enabled club and user,
+// otherwise it has nothing to send with.
+func remainsEnabled(keys []healthKey, disabling []healthKey, disabled map[healthKey]bool) bool {
+	healthMu.Lock()
+	defer healthMu.Unlock()
+
+	for _, d := range disabling {
+		ok := false
+
+		for _, key := range keys {
+			if key.tunnel == d.tunnel && key.name != d.name && !disabled[key] {
+				ok = true
+				break
+			}
+		}
+
+		if !ok {
+			return false
+		}
+	}
+
+	return true
+}
+
+func listAdminHealth(keys []healthKey, m map[healthKey]*health, disabled map[healthKey]bool) []adminHealth {
+	healthMu.Lock()
+	defer healthMu.Unlock()
+
+	list := []adminHealth{}
+
+	for _, key := range keys {
+		h := adminHealth{
+			Tunnel:   key.tunnel,
+			Name:     key.name,
+			Disabled: disabled[key],
+		}
+
+		if v, exists := m[key]; exists {
+			h.health = *v
+		}
+
+		list = append(list, h)
+	}
+
+	return list
+}
+
+func tunnelClubKeys(selected []*tunnel) []healthKey {
+	keys := []healthKey{}
+
+	for _, t := range selected {
+		for _, club := range t.loadConfig().Clubs {
+			keys = append(keys, clubHealthKey(club))
+		}
+	}
+
+	return keys
+}
+
+func tunnelUserKeys(selected []*tunnel) []healthKey {
+	keys := []healthKey{}
+
+	for _, t := range selected {
+		for _, user := range t.loadConfig().Users {
+			keys = append(keys, userHealthKey(user))
+		}
+	}
+
+	return keys
+}
+
+func writeAdmin(w http.ResponseWriter, status int, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		slog.Error("admin: write", "err", err)
+	}
+}
+
+func writeAdminError(w http.ResponseWriter, status int, msg string) {
+	writeAdmin(w, status, map[string]string{"error": msg})
+}
@@ -3,14 +3,20 @@ package main
 import (
 	"bytes"
 	"context"
+	"crypto/tls"
+	"crypto/x509"
 	"encoding/json"
 	"errors"
 	"fmt"
 	"io"
 	"mime/multipart"
+	"net"
 	"net/http"
 	"net/url"
+	"os"
+	"strconv"
 	"strings"
+	"time"
 )
 
 var (
@@ -18,19 +24,175 @@ var (
 	errFloodControl    = errors.New("flood control")
 )
 
-func apiURL(method string, values url.Values) string {
+func apiURL(cfg configAPI, method string, values url.Values) string {
 	method = strings.TrimPrefix(method, "/")
+	base := strings.TrimSuffix(cfg.URL, "/")
 
-	return fmt.Sprintf("https://api.vk.ru/method/%v?%s", method, values.Encode())
+	return fmt.Sprintf("%v/%v?%s", base, method, values.Encode())
 }
 
-func apiValues(token string) url.Values {
+func apiValues(cfg configAPI, token string) url.Values {
 	return url.Values{
-		"v":            []string{"5.199"},
+		"v":            []string{cfg.Version},
 		"access_token": []string{token},
 	}
 }
 
+func apiUploadURL(cfg configAPI, uri string) (string, error) {
+	if len(cfg.UploadHost) == 0 {
+		return uri, nil
+	}
+
+	parsed, err := url.Parse(uri)
+
+	if err != nil {
+		return "", err
+	}
+
+	if scheme, host, found := strings.Cut(cfg.UploadHost, "://"); found {
+		parsed.Scheme = scheme
+		parsed.Host = host
+	} else {
+		parsed.Host = cfg.UploadHost
+	}
+
+	return parsed.String(), nil
+}
+
+func newAPIClient(cfg configAPI) (*http.Client, error) {
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+
+	if len(cfg.Proxy) > 0 {
+		proxy, err := url.Parse(cfg.Proxy)
+
+		if err != nil {
+			return nil, fmt.Errorf("proxy: %v", err)
+		}
+
+		transport.Proxy = http.ProxyURL(proxy)
+	}
+
+	localAddr, err := apiLocalAddr(cfg)
+
+	if err != nil {
+		return nil, err
+	}
+
+	if localAddr != nil {
+		dialer := &net.Dialer{
+			Timeout:   30 * time.Second,
+			KeepAlive: 30 * time.Second,
+			LocalAddr: localAddr,
+		}
+		transport.DialContext = dialer.DialContext
+	}
+
+	tlsConfig, err := apiTLSConfig(cfg.TLS)
+
+	if err != nil {
+		return nil, fmt.Errorf("tls: %v", err)
+	}
+
+	transport.TLSClientConfig = tlsConfig
+
+	client := &http.Client{
+		Transport: transport,
+	}
+
+	return client, nil
+}
+
+func apiLocalAddr(cfg configAPI) (*net.TCPAddr, error) {
+	if len(cfg.BindAddress) > 0 {
+		ip := net.ParseIP(cfg.BindAddress)
+
+		if ip == nil {
+			return nil, fmt.Errorf("bind address: invalid ip: %v", cfg.BindAddress)
+		}
+
+		return &net.TCPAddr{IP: ip}, nil
+	}
+
+	if len(cfg.Interface) == 0 {
+		return nil, nil
+	}
+
+	iface, err := net.InterfaceByName(cfg.Interface)
+
+	if err != nil {
+		return nil, fmt.Errorf("interface: %v", err)
+	}
+
+	addrs, err := iface.Addrs()
+
+	if err != nil {
+		return nil, fmt.Errorf("interface: %v", err)
+	}
+
+	var fallback net.IP
+
+	for _, addr := range addrs {
+		ipNet, ok := addr.(*net.IPNet)
+
+		if !ok || ipNet.IP.IsLinkLocalUnicast() {
+			continue
+		}
+
+		if ipNet.IP.To4() != nil {
+			return &net.TCPAddr{IP: ipNet.IP}, nil
+		}
+
+		if fallback == nil {
+			fallback = ipNet.IP
+		}
+	}
+
+	if fallback == nil {
+		return nil, fmt.Errorf("interface: %v has no addresses", cfg.Interface)
+	}
+
+	return &net.TCPAddr{IP: fallback}, nil
+}
+
+func apiTLSConfig(cfg configAPITLS) (*tls.Config, error) {
+	tlsConfig := &tls.Config{
+		InsecureSkipVerify: cfg.Insecure,
+		ServerName:         cfg.ServerName,
+	}
+
+	switch cfg.MinVersion {
+	case "":
+	case "1.2":
+		tlsConfig.MinVersion = tls.VersionTLS12
+	case "1.3":
+		tlsConfig.MinVersion = tls.VersionTLS13
+	default:
+		return nil, fmt.Errorf("unsupported min version: %v", cfg.MinVersion)
+	}
+
+	if len(cfg.CAFile) > 0 {
+		data, err := os.ReadFile(cfg.CAFile)
+
+		if err != nil {
+			return nil, err
+		}
+
+		pool, err := x509.SystemCertPool()
+
+		if err != nil {
+			pool = x509.NewCertPool()
+		}
+
+		if !pool.AppendCertsFromPEM(data) {
+			return nil, fmt.Errorf("no certificates in %v", cfg.CAFile)
+		}
+
+		tlsConfig.RootCAs = pool
+	}
+
+	return tlsConfig, nil
+}
+
 func apiForm(fields map[string]string, files map[string][]byte) (io.Reader, string, error) {
 	body := &bytes.Buffer{}
 	writer := multipart.NewWriter(body)
@@ -62,6 +224,13 @@ func apiForm(fields map[string]string, files map[string][]byte) (io.Reader, stri
 }
 
 func apiDo(cfg configAPI, club configClub, user configUser, req *http.Request) ([]byte, error) {
+	data, err := apiDoRequest(cfg, club, user, req)
+	recordAPIHealth(club, user, err)
+
+	return data, err
+}
+
+func apiDoRequest(cfg configAPI, club configClub, user configUser, req *http.Request) ([]byte, error) {
 	if timeout := cfg.Timeout(); timeout > 0 {
 		ctx, cancel := context.WithTimeout(req.Context(), timeout)
 		defer cancel()
@@ -69,28 +238,58 @@ func apiDo(cfg configAPI, club configClub, user configUser, req *http.Request) (
 		req = req.WithContext(ctx)
 	}
 
-	resp, err := http.DefaultClient.Do(req)
+	client := cfg.Client
+
+	if client == nil {
+		client = http.DefaultClient
+	}
+
+	start := time.Now()
+	resp, err := client.Do(req)
+
+	method := req.URL.Path
+	label := "other"
+
+	if base, err := url.Parse(cfg.URL); err == nil {
+		prefix := strings.TrimSuffix(base.Path, "/") + "/"
+
+		if strings.HasPrefix(method, prefix) {
+			method = strings.TrimPrefix(method, prefix)
+			label = method
+		}
+	}
 
-	method := strings.TrimPrefix(req.URL.Path, "/method/")
 	descr := fmt.Sprintf("(method=%v club=%v user=%v)", method, club.Name, user.Name)
+	tunnel := apiTunnel(club, user)
+	result := "error"
+
+	defer func() {
+		metricAPIRequests.observe(time.Since(start).Seconds(), tunnel, label, result)
+	}()
 
 	if err != nil {
 		if e, ok := err.(*url.Error); ok {
 			e.URL = req.URL.Path
 		}
 
+		metricAPIErrors.inc(tunnel, label, "network")
+
 		return nil, fmt.Errorf("%v %v", err, descr)
 	}
 
 	defer resp.Body.Close()
 
 	if resp.StatusCode != http.StatusOK {
+		metricAPIErrors.inc(tunnel, label, fmt.Sprintf("http_%v", resp.StatusCode))
+
 		return nil, fmt.Errorf("HTTP %v %v", resp.StatusCode, descr)
 	}
 
 	data, err := io.ReadAll(resp.Body)
 
 	if err != nil {
+		metricAPIErrors.inc(tunnel, label, "network")
+
 		return nil, fmt.Errorf("read: %v %v", err, descr)
 	}
 
@@ -102,12 +301,18 @@ func apiDo(cfg configAPI, club configClub, user configUser, req *http.Request) (
 		if err := json.Unmarshal(data, &res1); err == nil {
 			if err := res1.check(); err != nil {
 				checkErr = err
+				metricAPIErrors.inc(tunnel, label, strconv.Itoa(res1.Error.ErrorCode))
+
+				if errors.Is(err, errFloodControl) {
+					metricFloodControl.inc(tunnel, label, club.Name)
+				}
 			}
 		}
 
 		if err := json.Unmarshal(data, &res2); err == nil {
 			if err := res2.check(); err != nil {
 				checkErr = err
+				metricAPIErrors.inc(tunnel, label, res2.Error)
 			}
 		}
 
@@ -116,9 +321,19 @@ func apiDo(cfg configAPI, club configClub, user configUser, req *http.Request) (
 		}
 	}
 
+	result = "ok"
+
 	return data, nil
 }
 
+func apiTunnel(club configClub, user configUser) string {
+	if len(club.Tunnel) > 0 {
+		return club.Tunnel
+	}
+
+	return user.Tunnel
+}
+
 type apiDownloadParams struct {
 	url string
 }
@@ -204,8 +419,8 @@ func messagesSend(cfg configAPI, club configClub, user configUser, params messag
 		return messagesSendResponse{}, err
 	}
 
-	values := apiValues(club.AccessToken)
-	uri := apiURL("messages.send", values)
+	values := apiValues(cfg, club.AccessToken)
+	uri := apiURL(cfg, "messages.send", values)
 	req, err := http.NewRequest(http.MethodPost, uri, body)
 
 	if err != nil {
@@ -256,11 +471,11 @@ func (r groupsGetLongPollServerResponse) check() error {
 }
 
 func groupsGetLongPollServer(cfg configAPI, club configClub) (groupsGetLongPollServerResponse, error) {
-	values := apiValues(club.AccessToken)
+	values := apiValues(cfg, club.AccessToken)
 
 	values.Set("group_id", club.ID)
 
-	uri := apiURL("groups.getLongPollServer", values)
+	uri := apiURL(cfg, "groups.getLongPollServer", values)
 	req, err := http.NewRequest(http.MethodGet, uri, nil)
 
 	if err != nil {
@@ -404,11 +619,11 @@ type groupsGetLongPollSettingsResponse struct {
 }
 
 func groupsGetLongPollSettings(cfg configAPI, club configClub) (groupsGetLongPollSettingsResponse, error) {
-	values := apiValues(club.AccessToken)
+	values := apiValues(cfg, club.AccessToken)
 
 	values.Set("group_id", club.ID)
 
-	uri := apiURL("groups.getLongPollSettings", values)
+	uri := apiURL(cfg, "groups.getLongPollSettings", values)
 	req, err := http.NewRequest(http.MethodGet, uri, nil)
 
 	if err != nil {
@@ -453,8 +668,8 @@ func wallPost(cfg configAPI, club configClub, params wallPostParams) (wallPostRe
 		return wallPostResponse{}, err
 	}
 
-	values := apiValues(club.AccessToken)
-	uri := apiURL("wall.post", values)
+	values := apiValues(cfg, club.AccessToken)
+	uri := apiURL(cfg, "wall.post", values)
 	req, err := http.NewRequest(http.MethodPost, uri, body)
 
 	if err != nil {
@@ -503,8 +718,8 @@ func wallCreateComment(cfg configAPI, club configClub, params wallCreateCommentP
 		return wallCreateCommentResponse{}, err
 	}
 
-	values := apiValues(club.AccessToken)
-	uri := apiURL("wall.createComment", values)
+	values := apiValues(cfg, club.AccessToken)
+	uri := apiURL(cfg, "wall.createComment", values)
 	req, err := http.NewRequest(http.MethodPost, uri, body)
 
 	if err != nil {
@@ -537,11 +752,11 @@ type docsGetWallUploadServerResponse struct {
 }
 
 func docsGetWallUploadServer(cfg configAPI, club configClub) (docsGetWallUploadServerResponse, error) {
-	values := apiValues(club.AccessToken)
+	values := apiValues(cfg, club.AccessToken)
 
 	values.Set("group_id", club.ID)
 
-	uri := apiURL("docs.getWallUploadServer", values)
+	uri := apiURL(cfg, "docs.getWallUploadServer", values)
 	req, err := http.NewRequest(http.MethodGet, uri, nil)
 
 	if err != nil {
@@ -586,7 +801,13 @@ func docsUpload(cfg configAPI, params docsUploadParams) (docsUploadResponse, err
 		return docsUploadResponse{}, err
 	}
 
-	req, err := http.NewRequest(http.MethodPost, params.uploadURL, body)
+	uploadURL, err := apiUploadURL(cfg, params.uploadURL)
+
+	if err != nil {
+		return docsUploadResponse{}, err
+	}
+
+	req, err := http.NewRequest(http.MethodPost, uploadURL, body)
 
 	if err != nil {
 		return docsUploadResponse{}, err
@@ -629,11 +850,11 @@ type document struct {
 }
 
 func docsSave(cfg configAPI, club configClub, params docsSaveParams) (docsSaveResponse, error) {
-	values := apiValues(club.AccessToken)
+	values := apiValues(cfg, club.AccessToken)
 
 	values.Set("file", params.file)
 
-	uri := apiURL("docs.save", values)
+	uri := apiURL(cfg, "docs.save", values)
 	req, err := http.NewRequest(http.MethodGet, uri, nil)
 
 	if err != nil {
@@ -695,12 +916,12 @@ func photosGetUploadServer(cfg configAPI, club configClub, user configUser) (pho
 		return photosGetUploadServerResponse{}, errUnathorizedUser
 	}
 
-	values := apiValues(user.AccessToken)
+	values := apiValues(cfg, user.AccessToken)
 
 	values.Set("group_id", club.ID)
 	values.Set("album_id", club.AlbumID)
 
-	uri := apiURL("photos.getUploadServer", values)
+	uri := apiURL(cfg, "photos.getUploadServer", values)
 	req, err := http.NewRequest(http.MethodGet, uri, nil)
 
 	if err != nil {
@@ -747,7 +968,13 @@ func photosUpload(cfg configAPI, params photosUploadParams) (photosUploadRespons
 		return photosUploadResponse{}, err
 	}
 
-	req, err := http.NewRequest(http.MethodPost, params.uploadURL, body)
+	uploadURL, err := apiUploadURL(cfg, params.uploadURL)
+
+	if err != nil {
+		return photosUploadResponse{}, err
+	}
+
+	req, err := http.NewRequest(http.MethodPost, uploadURL, body)
 
 	if err != nil {
 		return photosUploadResponse{}, err
@@ -794,7 +1021,7 @@ func photosSave(cfg configAPI, club configClub, user configUser, params photosSa
 		return photosSaveResponse{}, errUnathorizedUser
 	}
 
-	values := apiValues(user.AccessToken)
+	values := apiValues(cfg, user.AccessToken)
 
 	values.Set("group_id", club.ID)
 	values.Set("album_id", club.AlbumID)
@@ -803,7 +1030,7 @@ func photosSave(cfg configAPI, club configClub, user configUser, params photosSa
 	values.Set("hash", params.hash)
 	values.Set("caption", params.caption)
 
-	uri := apiURL("photos.save", values)
+	uri := apiURL(cfg, "photos.save", values)
 	req, err := http.NewRequest(http.MethodGet, uri, nil)
 
 	if err != nil {
@@ -874,12 +1101,12 @@ type storageGetResponse struct {
 }
 
 func storageGet(cfg configAPI, club configClub, params storageGetParams) ([]storageGetResponse, error) {
-	values := apiValues(club.AccessToken)
+	values := apiValues(cfg, club.AccessToken)
 
 	values.Set("keys", strings.Join(params.keys, ","))
 	values.Set("user_id", club.ID)
 
-	uri := apiURL("storage.get", values)
+	uri := apiURL(cfg, "storage.get", values)
 	req, err := http.NewRequest(http.MethodGet, uri, nil)
 
 	if err != nil {
@@ -911,13 +1138,13 @@ type storageSetResult struct {
 }
 
 func storageSet(cfg configAPI, club configClub, params storageSetParams) error {
-	values := apiValues(club.AccessToken)
+	values := apiValues(cfg, club.AccessToken)
 
 	values.Set("key", params.key)
 	values.Set("value", params.value)
 	values.Set("user_id", club.ID)
 
-	uri := apiURL("storage.set", values)
+	uri := apiURL(cfg, "storage.set", values)
 	req, err := http.NewRequest(http.MethodGet, uri, nil)
 
 	if err != nil {
@@ -946,6 +1173,9 @@ func storageSet(cfg configAPI, club configClub, params storageSetParams) error {
 type groupsEditParams struct {
 	description string
 	website     string
+	private     bool
+	docs        bool
+	market      bool
 }
 
 type groupsEditResult struct {
@@ -953,7 +1183,7 @@ type groupsEditResult struct {
 }
 
 func groupsEdit(cfg configAPI, club configClub, params groupsEditParams) error {
-	values := apiValues(club.AccessToken)
+	values := apiValues(cfg, club.AccessToken)
 
 	values.Set("group_id", club.ID)
 
@@ -965,7 +1195,19 @@ func groupsEdit(cfg configAPI, club configClub, params groupsEditParams) error {
 		values.Set("website", params.website)
 	}
 
-	uri := apiURL("groups.edit", values)
+	if params.private {
+		values.Set("access", "2")
+	}
+
+	if params.docs {
+		values.Set("docs", "1")
+	}
+
+	if params.market {
+		values.Set("market", "1")
+	}
+
+	uri := apiURL(cfg, "groups.edit", values)
 	req, err := http.NewRequest(http.MethodGet, uri, nil)
 
 	if err != nil {
@@ -1015,8 +1257,8 @@ func videoCreateComment(cfg configAPI, club configClub, user configUser, params
 		return err
 	}
 
-	values := apiValues(user.AccessToken)
-	uri := apiURL("video.createComment", values)
+	values := apiValues(cfg, user.AccessToken)
+	uri := apiURL(cfg, "video.createComment", values)
 	req, err := http.NewRequest(http.MethodPost, uri, body)
 
 	if err != nil {
@@ -1068,8 +1310,8 @@ func photosCreateComment(cfg configAPI, club configClub, user configUser, params
 		return err
 	}
 
-	values := apiValues(user.AccessToken)
-	uri := apiURL("photos.createComment", values)
+	values := apiValues(cfg, user.AccessToken)
+	uri := apiURL(cfg, "photos.createComment", values)
 	req, err := http.NewRequest(http.MethodPost, uri, body)
 
 	if err != nil {
@@ -1121,8 +1363,8 @@ func marketCreateComment(cfg configAPI, club configClub, user configUser, params
 		return err
 	}
 
-	values := apiValues(user.AccessToken)
-	uri := apiURL("market.createComment", values)
+	values := apiValues(cfg, user.AccessToken)
+	uri := apiURL(cfg, "market.createComment", values)
 	req, err := http.NewRequest(http.MethodPost, uri, body)
 
 	if err != nil {
@@ -1179,8 +1421,8 @@ func boardAddTopic(cfg configAPI, club configClub, user configUser, params board
 		return boardAddTopicResponse{}, err
 	}
 
-	values := apiValues(user.AccessToken)
-	uri := apiURL("board.addTopic", values)
+	values := apiValues(cfg, user.AccessToken)
+	uri := apiURL(cfg, "board.addTopic", values)
 	req, err := http.NewRequest(http.MethodPost, uri, body)
 
 	if err != nil {
@@ -1237,8 +1479,8 @@ func boardCreateComment(cfg configAPI, club configClub, user configUser, params
 		return err
 	}
 
-	values := apiValues(user.AccessToken)
-	uri := apiURL("board.createComment", values)
+	values := apiValues(cfg, user.AccessToken)
+	uri := apiURL(cfg, "board.createComment", values)
 	req, err := http.NewRequest(http.MethodPost, uri, body)
 
 	if err != nil {
@@ -1275,8 +1517,8 @@ type groupsGetTokenPermissionsResponse struct {
 }
 
 func groupsGetTokenPermissions(cfg configAPI, club configClub) (groupsGetTokenPermissionsResponse, error) {
-	values := apiValues(club.AccessToken)
-	uri := apiURL("groups.getTokenPermissions", values)
+	values := apiValues(cfg, club.AccessToken)
+	uri := apiURL(cfg, "groups.getTokenPermissions", values)
 	req, err := http.NewRequest(http.MethodGet, uri, nil)
 
 	if err != nil {
@@ -1307,8 +1549,8 @@ type accountGetAppPermissionsResponse struct {
 }
 
 func accountGetAppPermissions(cfg configAPI, user configUser) (accountGetAppPermissionsResponse, error) {
-	values := apiValues(user.AccessToken)
-	uri := apiURL("account.getAppPermissions", values)
+	values := apiValues(cfg, user.AccessToken)
+	uri := apiURL(cfg, "account.getAppPermissions", values)
 	req, err := http.NewRequest(http.MethodGet, uri, nil)
 
 	if err != nil {
@@ -1333,3 +1575,377 @@ func accountGetAppPermissions(cfg configAPI, user configUser) (accountGetAppPerm
 
 	return resp, nil
 }
+
+type groupsSetLongPollSettingsParams struct {
+	events []string
+}
+
+type groupsSetLongPollSettingsResult struct {
+	Response int `json:"response"`
+}
+
+func groupsSetLongPollSettings(cfg configAPI, club configClub, params groupsSetLongPollSettingsParams) error {
+	values := apiValues(cfg, club.AccessToken)
+
+	values.Set("group_id", club.ID)
+	values.Set("enabled", "1")
+	values.Set("api_version", cfg.Version)
+
+	for _, event := range params.events {
+		values.Set(event, "1")
+	}
+
+	uri := apiURL(cfg, "groups.setLongPollSettings", values)
+	req, err := http.NewRequest(http.MethodGet, uri, nil)
+
+	if err != nil {
+		return err
+	}
+
+	data, err := apiDo(cfg, club, configUser{}, req)
+
+	if err != nil {
+		return err
+	}
+
+	result := groupsSetLongPollSettingsResult{}
+
+	if err := json.Unmarshal(data, &result); err != nil {
+		return err
+	}
+
+	if result.Response == 0 {
+		return errors.New("groups.setLongPollSettings: failed")
+	}
+
+	return nil
+}
+
+type photosCreateAlbumParams struct {
+	title string
+}
+
+type photosCreateAlbumResult struct {
+	Response photosCreateAlbumResponse `json:"response"`
+}
+
+type photosCreateAlbumResponse struct {
+	ID int `json:"id"`
+}
+
+func photosCreateAlbum(cfg configAPI, club configClub, user configUser, params photosCreateAlbumParams) (photosCreateAlbumResponse, error) {
+	if cfg.Unathorized {
+		return photosCreateAlbumResponse{}, errUnathorizedUser
+	}
+
+	values := apiValues(cfg, user.AccessToken)
+
+	values.Set("group_id", club.ID)
+	values.Set("title", params.title)
+	values.Set("upload_by_admins_only", "1")
+
+	uri := apiURL(cfg, "photos.createAlbum", values)
+	req, err := http.NewRequest(http.MethodGet, uri, nil)
+
+	if err != nil {
+		return photosCreateAlbumResponse{}, err
+	}
+
+	data, err := apiDo(cfg, club, user, req)
+
+	if err != nil {
+		return photosCreateAlbumResponse{}, err
+	}
+
+	result := photosCreateAlbumResult{}
+
+	if err := json.Unmarshal(data, &result); err != nil {
+		return photosCreateAlbumResponse{}, err
+	}
+
+	if result.Response.ID == 0 {
+		return photosCreateAlbumResponse{}, errors.New("photos.createAlbum: empty response")
+	}
+
+	return result.Response, nil
+}
+
+type videoSaveParams struct {
+	name string
+}
+
+type videoSaveResult struct {
+	Response videoSaveResponse `json:"response"`
+}
+
+type videoSaveResponse struct {
+	UploadURL string `json:"upload_url"`
+	VideoID   int    `json:"video_id"`
+}
+
+func videoSave(cfg configAPI, club configClub, user configUser, params videoSaveParams) (videoSaveResponse, error) {
+	if cfg.Unathorized {
+		return videoSaveResponse{}, errUnathorizedUser
+	}
+
+	values := apiValues(cfg, user.AccessToken)
+
+	values.Set("group_id", club.ID)
+	values.Set("name", params.name)
+	values.Set("wallpost", "0")
+
+	uri := apiURL(cfg, "video.save", values)
+	req, err := http.NewRequest(http.MethodGet, uri, nil)
+
+	if err != nil {
+		return videoSaveResponse{}, err
+	}
+
+	data, err := apiDo(cfg, club, user, req)
+
+	if err != nil {
+		return videoSaveResponse{}, err
+	}
+
+	result := videoSaveResult{}
+
+	if err := json.Unmarshal(data, &result); err != nil {
+		return videoSaveResponse{}, err
+	}
+
+	if result.Response.VideoID == 0 {
+		return videoSaveResponse{}, errors.New("video.save: empty response")
+	}
+
+	return result.Response, nil
+}
+
+type videoUploadParams struct {
+	uploadURL string
+	data      []byte
+}
+
+func videoUpload(cfg configAPI, params videoUploadParams) error {
+	files := map[string][]byte{
+		"video_file.mp4": params.data,
+	}
+	body, ct, err := apiForm(nil, files)
+
+	if err != nil {
+		return err
+	}
+
+	uploadURL, err := apiUploadURL(cfg, params.uploadURL)
+
+	if err != nil {
+		return err
+	}
+
+	req, err := http.NewRequest(http.MethodPost, uploadURL, body)
+
+	if err != nil {
+		return err
+	}
+
+	req.Header.Set("Content-Type", ct)
+
+	_, err = apiDo(cfg, configClub{}, configUser{}, req)
+
+	return err
+}
+
+type photosGetMarketUploadServerResult struct {
+	Response photosGetMarketUploadServerResponse `json:"response"`
+}
+
+type photosGetMarketUploadServerResponse struct {
+	UploadURL string `json:"upload_url"`
+}
+
+func photosGetMarketUploadServer(cfg configAPI, club configClub, user configUser) (photosGetMarketUploadServerResponse, error) {
+	if cfg.Unathorized {
+		return photosGetMarketUploadServerResponse{}, errUnathorizedUser
+	}
+
+	values := apiValues(cfg, user.AccessToken)
+
+	values.Set("group_id", club.ID)
+	values.Set("main_photo", "1")
+
+	uri := apiURL(cfg, "photos.getMarketUploadServer", values)
+	req, err := http.NewRequest(http.MethodGet, uri, nil)
+
+	if err != nil {
+		return photosGetMarketUploadServerResponse{}, err
+	}
+
+	data, err := apiDo(cfg, club, user, req)
+
+	if err != nil {
+		return photosGetMarketUploadServerResponse{}, err
+	}
+
+	result := photosGetMarketUploadServerResult{}
+
+	if err := json.Unmarshal(data, &result); err != nil {
+		return photosGetMarketUploadServerResponse{}, err
+	}
+
+	return result.Response, nil
+}
+
+type photosUploadMarketParams struct {
+	uploadURL string
+	data      []byte
+}
+
+type photosUploadMarketResponse struct {
+	Server   int    `json:"server"`
+	Photo    string `json:"photo"`
+	Hash     string `json:"hash"`
+	CropData string `json:"crop_data"`
+	CropHash string `json:"crop_hash"`
+}
+
+func photosUploadMarket(cfg configAPI, params photosUploadMarketParams) (photosUploadMarketResponse, error) {
+	files := map[string][]byte{
+		"file.jpg": params.data,
+	}
+	body, ct, err := apiForm(nil, files)
+
+	if err != nil {
+		return photosUploadMarketResponse{}, err
+	}
+
+	uploadURL, err := apiUploadURL(cfg, params.uploadURL)
+
+	if err != nil {
+		return photosUploadMarketResponse{}, err
+	}
+
+	req, err := http.NewRequest(http.MethodPost, uploadURL, body)
+
+	if err != nil {
+		return photosUploadMarketResponse{}, err
+	}
+
+	req.Header.Set("Content-Type", ct)
+
+	data, err := apiDo(cfg, configClub{}, configUser{}, req)
+
+	if err != nil {
+		return photosUploadMarketResponse{}, err
+	}
+
+	result := photosUploadMarketResponse{}
+
+	if err := json.Unmarshal(data, &result); err != nil {
+		return photosUploadMarketResponse{}, err
+	}
+
+	if result.Photo == "" || result.Photo == "[]" {
+		return photosUploadMarketResponse{}, errors.New("photos.uploadMarket: not uploaded")
+	}
+
+	return result, nil
+}
+
+type photosSaveMarketPhotoResult struct {
+	Response []photosSaveResponse `json:"response"`
+}
+
+func photosSaveMarketPhoto(cfg configAPI, club configClub, user configUser, params photosUploadMarketResponse) (photosSaveResponse, error) {
+	if cfg.Unathorized {
+		return photosSaveResponse{}, errUnathorizedUser
+	}
+
+	values := apiValues(cfg, user.AccessToken)
+
+	values.Set("group_id", club.ID)
+	values.Set("photo", params.Photo)
+	values.Set("server", fmt.Sprint(params.Server))
+	values.Set("hash", params.Hash)
+	values.Set("crop_data", params.CropData)
+	values.Set("crop_hash", params.CropHash)
+
+	uri := apiURL(cfg, "photos.saveMarketPhoto", values)
+	req, err := http.NewRequest(http.MethodGet, uri, nil)
+
+	if err != nil {
+		return photosSaveResponse{}, err
+	}
+
+	data, err := apiDo(cfg, club, user, req)
+
+	if err != nil {
+		return photosSaveResponse{}, err
+	}
+
+	result := photosSaveMarketPhotoResult{}
+
+	if err := json.Unmarshal(data, &result); err != nil {
+		return photosSaveResponse{}, err
+	}
+
+	if len(result.Response) == 0 {
+		return photosSaveResponse{}, errors.New("photos.saveMarketPhoto: empty response")
+	}
+
+	return result.Response[0], nil
+}
+
+type marketAddParams struct {
+	name        string
+	description string
+	categoryID  int
+	price       int
+	mainPhotoID int
+}
+
+type marketAddResult struct {
+	Response marketAddResponse `json:"response"`
+}
+
+type marketAddResponse struct {
+	MarketItemID int `json:"market_item_id"`
+}
+
+func marketAdd(cfg configAPI, club configClub, user configUser, params marketAddParams) (marketAddResponse, error) {
+	if cfg.Unathorized {
+		return marketAddResponse{}, errUnathorizedUser
+	}
+
+	values := apiValues(cfg, user.AccessToken)
+
+	values.Set("owner_id", "-"+club.ID)
+	values.Set("name", params.name)
+	values.Set("description", params.description)
+	values.Set("category_id", fmt.Sprint(params.categoryID))
+	values.Set("price", fmt.Sprint(params.price))
+	values.Set("main_photo_id", fmt.Sprint(params.mainPhotoID))
+
+	uri := apiURL(cfg, "market.add", values)
+	req, err := http.NewRequest(http.MethodGet, uri, nil)
+
+	if err != nil {
+		return marketAddResponse{}, err
+	}
+
+	data, err := apiDo(cfg, club, user, req)
+
+	if err != nil {
+		return marketAddResponse{}, err
+	}
+
+	result := marketAddResult{}
+
+	if err := json.Unmarshal(data, &result); err != nil {
+		return marketAddResponse{}, err
+	}
+
+	if result.Response.MarketItemID == 0 {
+		return marketAddResponse{}, errors.New("market.add: empty response")
+	}
+
+	return result.Response, nil
+}
@@ -0,0 +1,116 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+)
+
+const (
+	exitCodeError  = 1
+	exitCodeConfig = 2
+	exitCodeRemote = 3
+)
+
+type exitError struct {
+	code int
+	err  error
+}
+
+func (e exitError) Error() string {
+	return e.err.Error()
+}
+
+func (e exitError) Unwrap() error {
+	return e.err
+}
+
+func exitCode(err error) int {
+	var exitErr exitError
+
+	if errors.As(err, &exitErr) {
+		return exitErr.code
+	}
+
+	return exitCodeError
+}
+
+func runCheckConfig(name string, out io.Writer) error {
+	cfg, err := parseConfig(name)
+
+	if err != nil {
+		fmt.Fprintf(out, "config: %v\n", err)
+		return exitError{exitCodeConfig, errors.New("config is invalid")}
+	}
+
+	problems := checkConfig(cfg)
+
+	for _, problem := range problems {
+		fmt.Fprintln(out, problem)
+	}
+
+	if len(problems) > 0 {
+		return exitError{exitCodeConfig, fmt.Errorf("config problems found: %v", len(problems))}
+	}
+
+	problems = checkRemote(cfg)
+
+	for _, problem := range problems {
+		fmt.Fprintln(out, problem)
+	}
+
+	if len(problems) > 0 {
+		return exitError{exitCodeRemote, fmt.Errorf("remote problems found: %v", len(problems))}
+	}
+
+	fmt.Fprintln(out, "config is valid")
+
+	return nil
+}
+
+func checkRemote(cfg config) []error {
+	c := &configChecker{}
+
+	if err := configureDNS(cfg.DNS); err != nil {
+		c.add("dns", "is invalid: %v", err)
+	}
+
+	seen := map[string]bool{}
+
+	for i, tc := range cfg.tunnels() {
+		c.addTunnelProblems(cfg, i, checkTunnelRemote(tc.Config), seen)
+	}
+
+	return c.problems
+}
+
+func checkTunnelRemote(cfg config) []error {
+	c := &configChecker{}
+
+	if err := validateQR(cfg.QR); err != nil {
+		c.add("qr", "check failed: %v", err)
+	}
+
+	for i, club := range cfg.Clubs {
+		path := fmt.Sprintf("clubs[%v]", i)
+
+		if err := validateClub(cfg.API, club); err != nil {
+			c.add(path, "check failed: %v", err)
+			continue
+		}
+
+		if err := validateLongPoll(cfg.API, club); err != nil {
+			c.add(path, "long poll check failed: %v", err)
+		}
+	}
+
+	for i, user := range cfg.Users {
+		path := fmt.Sprintf("users[%v]", i)
+
+		if err := validateUser(cfg.API, user); err != nil {
+			c.add(path, "check failed: %v", err)
+		}
+	}
+
+	return c.problems
+}
@@ -7,26 +7,78 @@ import (
 	"fmt"
 	"log/slog"
 	"net"
+	"net/http"
+	"net/url"
 	"os"
+	"slices"
+	"strconv"
 	"strings"
 	"time"
 )
 
 type config struct {
-	Log     configLog     `json:"log"`
-	DNS     configDNS     `json:"dns"`
-	Session configSession `json:"session"`
-	Socks   configSocks   `json:"socks"`
-	API     configAPI     `json:"api"`
-	QR      configQR      `json:"qr"`
-	Clubs   []configClub  `json:"clubs"`
-	Users   []configUser  `json:"users"`
+	Log           configLog         `json:"log"`
+	DNS           configDNS         `json:"dns"`
+	DNSServer     configDNSServer   `json:"dnsServer"`
+	Session       configSession     `json:"session"`
+	Socks         configSocks       `json:"socks"`
+	Routing       configRouting     `json:"routing"`
+	Transparent   configTransparent `json:"transparent"`
+	Forwards      []configForward   `json:"forwards"`
+	ACL           configACL         `json:"acl"`
+	Upstream      configUpstream    `json:"upstream"`
+	API           configAPI         `json:"api"`
+	QR            configQR          `json:"qr"`
+	Faults        configFaults      `json:"faults"`
+	Metrics       configMetrics     `json:"metrics"`
+	Admin         configAdmin       `json:"admin"`
+	Trace         configTrace       `json:"trace"`
+	Secrets       string            `json:"secrets"`
+	SharedSecrets bool              `json:"-"`
+	Clubs         []configClub      `json:"clubs"`
+	Users         []configUser      `json:"users"`
+
+	Tunnels       []map[string]json.RawMessage `json:"tunnels"`
+	TunnelConfigs []configTunnel               `json:"-"`
+}
+
+type configTunnel struct {
+	Name   string
+	Config config
+}
+
+// Config without tunnels is a single unnamed tunnel.
+func (cfg config) tunnels() []configTunnel {
+	if len(cfg.Tunnels) == 0 {
+		return []configTunnel{{Config: cfg}}
+	}
+
+	return cfg.TunnelConfigs
 }
 
 type configLog struct {
-	Level   int    `json:"level"`
-	Output  string `json:"output"`
-	Payload bool   `json:"payload"`
+	Level         int             `json:"level"`
+	Format        string          `json:"format"`
+	Output        string          `json:"output"`
+	Payload       bool            `json:"payload"`
+	PayloadOutput string          `json:"payloadOutput"`
+	PayloadRate   int             `json:"payloadRate"`
+	Rotate        configLogRotate `json:"rotate"`
+}
+
+type configLogRotate struct {
+	MaxSize    int  `json:"maxSize"`
+	MaxAgeMS   int  `json:"maxAge"`
+	MaxBackups int  `json:"maxBackups"`
+	Compress   bool `json:"compress"`
+}
+
+func (c configLogRotate) MaxAge() time.Duration {
+	return time.Duration(c.MaxAgeMS) * time.Millisecond
+}
+
+func (c configLogRotate) isEnabled() bool {
+	return c.MaxSize > 0 || c.MaxAgeMS > 0
 }
 
 type configDNS struct {
@@ -35,30 +87,137 @@ type configDNS struct {
 	Provider string `json:"provider"`
 }
 
+type configDNSServer struct {
+	Host       string `json:"host"`
+	Port       uint16 `json:"port"`
+	TimeoutMS  int    `json:"timeout"`
+	CacheTTLMS int    `json:"cacheTTL"`
+}
+
+func (cfg configDNSServer) Timeout() time.Duration {
+	return time.Duration(cfg.TimeoutMS) * time.Millisecond
+}
+
+func (cfg configDNSServer) CacheTTL() time.Duration {
+	return time.Duration(cfg.CacheTTLMS) * time.Millisecond
+}
+
 type configSession struct {
-	TimeoutMS int    `json:"timeout"`
-	Secret    string `json:"secret"`
-	SecretKey []byte `json:"-"`
+	TimeoutMS int                `json:"timeout"`
+	Secret    string             `json:"secret"`
+	SecretKey []byte             `json:"-"`
+	Keys      []configSessionKey `json:"keys"`
+	ActiveKey int                `json:"activeKey"`
+	GraceMS   int                `json:"grace"`
+	Device    int64              `json:"device"`
 }
 
 func (cfg configSession) Timeout() time.Duration {
 	return time.Duration(cfg.TimeoutMS) * time.Millisecond
 }
 
+func (cfg configSession) Grace() time.Duration {
+	return time.Duration(cfg.GraceMS) * time.Millisecond
+}
+
+type configSessionKey struct {
+	ID     int    `json:"id"`
+	Secret string `json:"secret"`
+	Key    []byte `json:"-"`
+}
+
 type configSocks struct {
 	Host              string `json:"host"`
 	Port              uint16 `json:"port"`
 	ForwardSize       int    `json:"forwardSize"`
 	ForwardIntervalMS int    `json:"forwardInterval"`
+	ConnectTimeoutMS  int    `json:"connectTimeout"`
 }
 
 func (cfg configSocks) ForwardInterval() time.Duration {
 	return time.Duration(cfg.ForwardIntervalMS) * time.Millisecond
 }
 
+func (cfg configSocks) ConnectTimeout() time.Duration {
+	return time.Duration(cfg.ConnectTimeoutMS) * time.Millisecond
+}
+
+type configTransparent struct {
+	Host string `json:"host"`
+	Port uint16 `json:"port"`
+	Mode string `json:"mode"`
+}
+
+type configForward struct {
+	Listen  string `json:"listen"`
+	Target  string `json:"target"`
+	Reverse bool   `json:"reverse"`
+}
+
+type configRule struct {
+	Action  string   `json:"action"`
+	Domains []string `json:"domains"`
+	CIDRs   []string `json:"cidrs"`
+	Ports   []string `json:"ports"`
+	Files   []string `json:"files"`
+	Resolve bool     `json:"resolve"`
+}
+
+type configRouting struct {
+	Default  string       `json:"default"`
+	DirectVK bool         `json:"directVK"`
+	Rules    []configRule `json:"rules"`
+	RuleSet  ruleSet      `json:"-"`
+}
+
+type configACL struct {
+	Default      string            `json:"default"`
+	AllowPrivate bool              `json:"allowPrivate"`
+	Rules        []configRule      `json:"rules"`
+	Devices      []configACLDevice `json:"devices"`
+	RuleSet      ruleSet           `json:"-"`
+}
+
+type configACLDevice struct {
+	Device  int64        `json:"device"`
+	Default string       `json:"default"`
+	Rules   []configRule `json:"rules"`
+	RuleSet ruleSet      `json:"-"`
+}
+
+type configUpstream struct {
+	Default string                `json:"default"`
+	Proxies []configUpstreamProxy `json:"proxies"`
+	Rules   []configRule          `json:"rules"`
+	RuleSet ruleSet               `json:"-"`
+}
+
+type configUpstreamProxy struct {
+	Name     string `json:"name"`
+	Type     string `json:"type"`
+	Address  string `json:"address"`
+	Username string `json:"username"`
+	Password string `json:"password"`
+}
+
 type configAPI struct {
-	TimeoutMS   int  `json:"-"`
-	Unathorized bool `json:"unathorized"`
+	TimeoutMS   int          `json:"-"`
+	URL         string       `json:"url"`
+	Version     string       `json:"version"`
+	UploadHost  string       `json:"uploadHost"`
+	Unathorized bool         `json:"unathorized"`
+	Proxy       string       `json:"proxy"`
+	Interface   string       `json:"interface"`
+	BindAddress string       `json:"bindAddress"`
+	TLS         configAPITLS `json:"tls"`
+	Client      *http.Client `json:"-"`
+}
+
+type configAPITLS struct {
+	Insecure   bool   `json:"insecure"`
+	CAFile     string `json:"caFile"`
+	ServerName string `json:"serverName"`
+	MinVersion string `json:"minVersion"`
 }
 
 func (cfg configAPI) Timeout() time.Duration {
@@ -72,6 +231,47 @@ type configQR struct {
 	SaveDir    string `json:"saveDir"`
 }
 
+type configMetrics struct {
+	Host string `json:"host"`
+	Port uint16 `json:"port"`
+}
+
+type configAdmin struct {
+	Host  string `json:"host"`
+	Port  uint16 `json:"port"`
+	Token string `json:"token"`
+}
+
+type configTrace struct {
+	Output string `json:"output"`
+}
+
+type configFaults struct {
+	Send    configFault `json:"send"`
+	Receive configFault `json:"receive"`
+}
+
+type configFault struct {
+	Drop          float64 `json:"drop"`
+	Duplicate     float64 `json:"duplicate"`
+	Delay         float64 `json:"delay"`
+	DelayTimeMS   int     `json:"delayTime"`
+	Reorder       float64 `json:"reorder"`
+	ReorderTimeMS int     `json:"reorderTime"`
+}
+
+func (cfg configFault) DelayTime() time.Duration {
+	return time.Duration(cfg.DelayTimeMS) * time.Millisecond
+}
+
+func (cfg configFault) ReorderTime() time.Duration {
+	return time.Duration(cfg.ReorderTimeMS) * time.Millisecond
+}
+
+func (cfg configFault) isEnabled() bool {
+	return cfg.Drop > 0 || cfg.Duplicate > 0 || cfg.Delay > 0 || cfg.Reorder > 0
+}
+
 type configClub struct {
 	Name        string `json:"name"`
 	ID          string `json:"id"`
@@ -80,30 +280,67 @@ type configClub struct {
 	PhotoID     string `json:"photoID"`
 	VideoID     string `json:"videoID"`
 	MarketID    string `json:"marketID"`
+	Tunnel      string `json:"-"`
 }
 
 type configUser struct {
 	Name        string `json:"name"`
 	ID          string `json:"id"`
 	AccessToken string `json:"accessToken"`
+	Tunnel      string `json:"-"`
 }
 
 func defaultConfig() config {
 	return config{
 		Log: configLog{
-			Level: 0,
+			Level:       0,
+			Format:      logFormatText,
+			PayloadRate: 50,
+		},
+		DNSServer: configDNSServer{
+			Host:       "127.0.0.1",
+			Port:       0,
+			TimeoutMS:  30 * 1000,
+			CacheTTLMS: 10 * 60 * 1000,
 		},
 		Session: configSession{
 			TimeoutMS: 30 * 1000,
+			GraceMS:   24 * 60 * 60 * 1000,
 		},
 		Socks: configSocks{
 			Host:              "127.0.0.1",
 			Port:              1080,
 			ForwardSize:       1 * 1024 * 1024,
 			ForwardIntervalMS: 500,
+			ConnectTimeoutMS:  30 * 1000,
+		},
+		Metrics: configMetrics{
+			Host: "127.0.0.1",
+			Port: 0,
+		},
+		Admin: configAdmin{
+			Host: "127.0.0.1",
+			Port: 0,
+		},
+		Transparent: configTransparent{
+			Host: "0.0.0.0",
+			Port: 0,
+			Mode: transparentModeRedirect,
+		},
+		Routing: configRouting{
+			Default:  ruleActionTunnel,
+			DirectVK: true,
+		},
+		ACL: configACL{
+			Default: ruleActionAllow,
+		},
+		Upstream: configUpstream{
+			Default: ruleActionDirect,
 		},
 		API: configAPI{
 			TimeoutMS: 10 * 1000,
+			URL:       "https://api.vk.ru/method/",
+			Version:   "5.199",
 		},
 		QR: configQR{
 			ZBarPath:   "zbarimg",
@@ -126,81 +363,393 @@ func parseConfig(name string) (config, error) {
 		return cfg, nil
 	}
 
+	data, err = expandEnv(data)
+
+	if err != nil {
+		return config{}, fmt.Errorf("env: %v", err)
+	}
+
 	if err := json.Unmarshal(data, &cfg); err != nil {
 		return config{}, err
 	}
 
+	// Top level config of tunnels is only a base for them,
+	// so it isn't prepared itself.
+	if len(cfg.Tunnels) > 0 {
+		for i, overrides := range cfg.Tunnels {
+			tc, err := parseTunnelConfig(name, data, overrides)
+
+			if err != nil {
+				return config{}, fmt.Errorf("tunnels[%v]: %v", i, err)
+			}
+
+			cfg.TunnelConfigs = append(cfg.TunnelConfigs, tc)
+		}
+
+		if err := checkSharedSecrets(cfg, name); err != nil {
+			return config{}, fmt.Errorf("secrets: %v", err)
+		}
+
+		return cfg, nil
+	}
+
+	if err := prepareConfig(&cfg, name); err != nil {
+		return config{}, err
+	}
+
+	return cfg, nil
+}
+
+func prepareConfig(cfg *config, name string) error {
+	if len(cfg.Secrets) > 0 {
+		if err := applySecrets(cfg, name); err != nil {
+			return fmt.Errorf("secrets: %v", err)
+		}
+	}
+
 	if len(cfg.Session.Secret) > 0 {
-		key, err := secretToKey(cfg.Session.Secret)
+		if key, err := secretToKey(cfg.Session.Secret); err == nil {
+			cfg.Session.SecretKey = key
+		}
+	}
+
+	for i, key := range cfg.Session.Keys {
+		if b, err := secretToKey(key.Secret); err == nil {
+			cfg.Session.Keys[i].Key = b
+		}
+	}
+
+	client, err := newAPIClient(cfg.API)
+
+	if err != nil {
+		return fmt.Errorf("api: %v", err)
+	}
+
+	cfg.API.Client = client
+
+	aclActions := []string{ruleActionAllow, ruleActionDeny}
+	aclBuiltin := aclBuiltinRules(*cfg)
+	acl, err := newRuleSet(cfg.ACL.Default, slices.Concat(aclBuiltin, cfg.ACL.Rules), aclActions)
+
+	if err != nil {
+		return fmt.Errorf("acl: %v", err)
+	}
+
+	cfg.ACL.RuleSet = acl
+
+	for i, dev := range cfg.ACL.Devices {
+		action := dev.Default
+
+		if len(action) == 0 {
+			action = cfg.ACL.Default
+		}
+
+		rs, err := newRuleSet(action, slices.Concat(aclBuiltin, dev.Rules), aclActions)
 
 		if err != nil {
-			return config{}, err
+			return fmt.Errorf("acl: device %v: %v", dev.Device, err)
 		}
 
-		cfg.Session.SecretKey = key
+		cfg.ACL.Devices[i].RuleSet = rs
 	}
 
-	return cfg, nil
+	routingRules := cfg.Routing.Rules
+
+	if cfg.Routing.DirectVK {
+		vk := configRule{
+			Action:  ruleActionDirect,
+			Domains: vkDomains,
+		}
+		routingRules = append([]configRule{vk}, routingRules...)
+	}
+
+	routing, err := newRuleSet(cfg.Routing.Default, routingRules, []string{ruleActionDirect, ruleActionTunnel})
+
+	if err != nil {
+		return fmt.Errorf("routing: %v", err)
+	}
+
+	cfg.Routing.RuleSet = routing
+
+	upstreams := []string{ruleActionDirect}
+
+	for _, proxy := range cfg.Upstream.Proxies {
+		upstreams = append(upstreams, proxy.Name)
+	}
+
+	upstream, err := newRuleSet(cfg.Upstream.Default, cfg.Upstream.Rules, upstreams)
+
+	if err != nil {
+		return fmt.Errorf("upstream: %v", err)
+	}
+
+	cfg.Upstream.RuleSet = upstream
+
+	return nil
+}
+
+type configProblem struct {
+	path string
+	msg  string
+}
+
+func (p configProblem) Error() string {
+	return p.path + " " + p.msg
+}
+
+type configChecker struct {
+	problems []error
+}
+
+func (c *configChecker) add(path string, format string, args ...any) {
+	c.problems = append(c.problems, configProblem{path, fmt.Sprintf(format, args...)})
+}
+
+func (c *configChecker) required(path string, value string) bool {
+	if len(value) == 0 {
+		c.add(path, "is missing")
+		return false
+	}
+
+	return true
+}
+
+func (c *configChecker) numeric(path string, value string) {
+	if !c.required(path, value) {
+		return
+	}
+
+	if n, err := strconv.ParseInt(value, 10, 64); err != nil || n <= 0 {
+		c.add(path, "must be a positive number: %v", value)
+	}
 }
 
 func validateConfig(cfg config) error {
+	return errors.Join(checkConfig(cfg)...)
+}
+
+func checkConfig(cfg config) []error {
+	if len(cfg.Tunnels) > 0 {
+		return checkTunnels(cfg)
+	}
+
+	return checkTunnelConfig(cfg)
+}
+
+func checkTunnelConfig(cfg config) []error {
+	c := &configChecker{}
+
 	if len(cfg.Clubs) == 0 {
-		return errors.New("clubs are missing")
+		c.add("clubs", "are missing")
 	}
 
 	if len(cfg.Users) == 0 {
-		return errors.New("users are missing")
+		c.add("users", "are missing")
 	}
 
-	for _, club := range cfg.Clubs {
-		if club.Name == "" {
-			return errors.New("club.name is missing")
+	clubNames := map[string]bool{}
+
+	for i, club := range cfg.Clubs {
+		path := fmt.Sprintf("clubs[%v]", i)
+
+		if c.required(path+".name", club.Name) {
+			if clubNames[club.Name] {
+				c.add(path+".name", "is duplicated: %v", club.Name)
+			}
+
+			clubNames[club.Name] = true
 		}
 
-		if club.ID == "" {
-			return errors.New("club.id is missing")
+		c.numeric(path+".id", club.ID)
+		c.required(path+".accessToken", club.AccessToken)
+		c.numeric(path+".albumID", club.AlbumID)
+		c.numeric(path+".photoID", club.PhotoID)
+		c.numeric(path+".videoID", club.VideoID)
+		c.numeric(path+".marketID", club.MarketID)
+	}
+
+	userNames := map[string]bool{}
+
+	for i, user := range cfg.Users {
+		path := fmt.Sprintf("users[%v]", i)
+
+		if c.required(path+".name", user.Name) {
+			if userNames[user.Name] {
+				c.add(path+".name", "is duplicated: %v", user.Name)
+			}
+
+			userNames[user.Name] = true
 		}
 
-		if club.AccessToken == "" {
-			return errors.New("club.accessToken is missing")
+		c.numeric(path+".id", user.ID)
+
+		if !cfg.API.Unathorized {
+			c.required(path+".accessToken", user.AccessToken)
 		}
+	}
 
-		if club.AlbumID == "" {
-			return errors.New("club.albumID is missing")
+	if len(cfg.Session.Secret) > 0 || cfg.Session.ActiveKey == int(keyIDLegacy) {
+		if c.required("session.secret", cfg.Session.Secret) && len(cfg.Session.SecretKey) == 0 {
+			c.add("session.secret", "must be 64 hex characters, use -secret to generate it")
 		}
+	}
+
+	keyIDs := map[int]bool{}
 
-		if club.PhotoID == "" {
-			return errors.New("club.photoID is missing")
+	for i, key := range cfg.Session.Keys {
+		path := fmt.Sprintf("session.keys[%v]", i)
+
+		if key.ID < 1 || key.ID > 255 {
+			c.add(path+".id", "must be between 1 and 255")
+		} else if keyIDs[key.ID] {
+			c.add(path+".id", "is duplicated: %v", key.ID)
 		}
 
-		if club.VideoID == "" {
-			return errors.New("club.videoID is missing")
+		keyIDs[key.ID] = true
+
+		if c.required(path+".secret", key.Secret) && len(key.Key) == 0 {
+			c.add(path+".secret", "must be 64 hex characters, use -secret to generate it")
 		}
+	}
+
+	if cfg.Session.ActiveKey != int(keyIDLegacy) && !keyIDs[cfg.Session.ActiveKey] {
+		c.add("session.activeKey", "is not in session.keys: %v", cfg.Session.ActiveKey)
+	}
 
-		if club.MarketID == "" {
-			return errors.New("club.marketID is missing")
+	if cfg.Session.Device < 0 {
+		c.add("session.device", "must not be negative")
+	}
+
+	devices := map[int64]bool{}
+
+	for i, dev := range cfg.ACL.Devices {
+		path := fmt.Sprintf("acl.devices[%v].device", i)
+
+		if dev.Device <= 0 {
+			c.add(path, "must be positive")
+		} else if devices[dev.Device] {
+			c.add(path, "is duplicated: %v", dev.Device)
 		}
+
+		devices[dev.Device] = true
+	}
+
+	if cfg.Session.GraceMS < 0 {
+		c.add("session.grace", "must not be negative")
 	}
 
-	for _, user := range cfg.Users {
-		if user.Name == "" {
-			return errors.New("user.name is missing")
+	if cfg.Log.Format != logFormatText && cfg.Log.Format != logFormatJSON {
+		c.add("log.format", "is unknown: %v", cfg.Log.Format)
+	}
+
+	if cfg.Log.Payload && cfg.Log.PayloadRate <= 0 {
+		c.add("log.payloadRate", "must be positive")
+	}
+
+	if cfg.Log.Rotate.MaxSize < 0 {
+		c.add("log.rotate.maxSize", "must not be negative")
+	}
+
+	if cfg.Log.Rotate.MaxAgeMS < 0 {
+		c.add("log.rotate.maxAge", "must not be negative")
+	}
+
+	if cfg.Log.Rotate.MaxBackups < 0 {
+		c.add("log.rotate.maxBackups", "must not be negative")
+	}
+
+	if u, err := url.Parse(cfg.API.URL); err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		c.add("api.url", "is invalid: %v", cfg.API.URL)
+	}
+
+	c.required("api.version", cfg.API.Version)
+
+	if cfg.DNSServer.Port != 0 && cfg.DNSServer.TimeoutMS <= 0 {
+		c.add("dnsServer.timeout", "must be positive")
+	}
+
+	for i, fwd := range cfg.Forwards {
+		path := fmt.Sprintf("forwards[%v]", i)
+
+		if !fwd.Reverse {
+			c.required(path+".listen", fwd.Listen)
+		}
+
+		if _, err := parseAddress(fwd.Target); err != nil {
+			c.add(path+".target", "is invalid: %v", err)
+		}
+	}
+
+	for i, proxy := range cfg.Upstream.Proxies {
+		path := fmt.Sprintf("upstream.proxies[%v]", i)
+
+		if proxy.Name == "" || proxy.Name == ruleActionDirect {
+			c.add(path+".name", "is invalid: %v", proxy.Name)
 		}
 
-		if user.ID == "" {
-			return errors.New("user.id is missing")
+		if proxy.Type != upstreamTypeSocks5 && proxy.Type != upstreamTypeHTTP {
+			c.add(path+".type", "is unknown: %v", proxy.Type)
 		}
 
-		if user.AccessToken == "" && !cfg.API.Unathorized {
-			return errors.New("user.accessToken is missing")
+		c.required(path+".address", proxy.Address)
+
+		if proxy.Type == upstreamTypeSocks5 && len(proxy.Username) > 255 {
+			c.add(path+".username", "must not be longer than 255 bytes")
+		}
+
+		if proxy.Type == upstreamTypeSocks5 && len(proxy.Password) > 255 {
+			c.add(path+".password", "must not be longer than 255 bytes")
 		}
 	}
 
-	if len(cfg.Session.SecretKey) == 0 {
-		return errors.New("session.secret is missing")
+	if cfg.Transparent.Mode != transparentModeRedirect && cfg.Transparent.Mode != transparentModeTProxy {
+		c.add("transparent.mode", "is unknown: %v", cfg.Transparent.Mode)
 	}
 
-	return nil
+	if cfg.Admin.Port != 0 && !isLoopbackHost(cfg.Admin.Host) {
+		c.add("admin.host", "must be a loopback address")
+	}
+
+	checkFault(c, "faults.send", cfg.Faults.Send)
+	checkFault(c, "faults.receive", cfg.Faults.Receive)
+
+	return c.problems
+}
+
+func isLoopbackHost(host string) bool {
+	if host == "localhost" {
+		return true
+	}
+
+	ip := net.ParseIP(host)
+
+	return ip != nil && ip.IsLoopback()
+}
+
+func checkFault(c *configChecker, path string, cfg configFault) {
+	probabilities := []struct {
+		name  string
+		value float64
+	}{
+		{"drop", cfg.Drop},
+		{"duplicate", cfg.Duplicate},
+		{"delay", cfg.Delay},
+		{"reorder", cfg.Reorder},
+	}
+
+	for _, p := range probabilities {
+		if p.value < 0 || p.value > 1 {
+			c.add(path+"."+p.name, "must be between 0 and 1")
+		}
+	}
+
+	if cfg.Delay > 0 && cfg.DelayTimeMS <= 0 {
+		c.add(path+".delayTime", "must be positive")
+	}
+
+	if cfg.Reorder > 0 && cfg.ReorderTimeMS <= 0 {
+		c.add(path+".reorderTime", "must be positive")
+	}
 }
 
 func validateQR(cfg configQR) error {
@@ -276,6 +825,18 @@ func validateUser(cfg configAPI, user configUser) error {
 	return nil
 }
 
+var longPollEvents = []string{
+	"message_reply",
+	"photo_new",
+	"photo_comment_new",
+	"video_comment_new",
+	"wall_post_new",
+	"wall_reply_new",
+	"group_change_settings",
+	"market_comment_new",
+	"board_post_new",
+}
+
 func validateLongPoll(cfg configAPI, club configClub) error {
 	settings, err := groupsGetLongPollSettings(cfg, club)
 
@@ -287,19 +848,7 @@ func validateLongPoll(cfg configAPI, club configClub) error {
 		return errors.New("disabled")
 	}
 
-	required := []string{
-		"message_reply",
-		"photo_new",
-		"photo_comment_new",
-		"video_comment_new",
-		"wall_post_new",
-		"wall_reply_new",
-		"group_change_settings",
-		"market_comment_new",
-		"board_post_new",
-	}
-
-	for _, event := range required {
+	for _, event := range longPollEvents {
 		enabled, exists := settings.Events[event]
 
 		if !exists || enabled == 0 {
@@ -311,21 +860,24 @@ func validateLongPoll(cfg configAPI, club configClub) error {
 }
 
 func configureLogger(cfg configLog) error {
-	if len(cfg.Output) == 0 {
-		slog.SetLogLoggerLevel(slog.Level(cfg.Level))
-		return nil
-	}
-
-	f, err := os.OpenFile(cfg.Output, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+	w, err := openLogOutput(cfg.Output, cfg.Rotate)
 
 	if err != nil {
 		return err
 	}
 
-	handler := slog.NewTextHandler(f, &slog.HandlerOptions{
-		Level: slog.Level(cfg.Level),
-	})
-	logger := slog.New(handler)
+	if err := configurePayloadLogger(cfg, w); err != nil {
+		return fmt.Errorf("payload: %v", err)
+	}
+
+	logBridge = len(cfg.Output) == 0 && cfg.Format == logFormatText
+	setLogLevel(cfg.Level)
+
+	if logBridge {
+		return nil
+	}
+
+	logger := slog.New(newLogHandler(w, cfg.Format))
 
 	slog.SetDefault(logger)
 
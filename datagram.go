@@ -8,11 +8,14 @@ import (
 	"fmt"
 	"hash/crc32"
 	"math"
+	"net"
+	"sync"
 	"time"
 )
 
 type (
-	dgVer uint16
+	dgKey uint8
+	dgVer uint8
 	dgSum uint32
 	dgDev int64
 	dgSes int32
@@ -20,23 +23,62 @@ type (
 	dgCmd int16
 )
 
-const datagramHeaderLen = 2 + 4 + 8 + 4 + 4 + 2
+const datagramHeaderLen = 1 + 1 + 4 + 8 + 4 + 4 + 2
+
+// Since version 2 sessions opened by the interlocutor are stored
+// with negated ID. Version 1 peers use the ID as is.
+const (
+	datagramVersion        dgVer = 2
+	datagramVersionNegated dgVer = 2
+)
 
 const (
 	commandConnect dgCmd = iota + 1
 	commandForward
 	commandClose
 	commandRetry
+	commandConnectResult
+	commandResolve
+	commandResolveResult
+	commandConnectReverse
+)
+
+const (
+	connectResultSucceeded byte = iota
+	connectResultFailure
+	connectResultNotAllowed
+	connectResultNetworkUnreachable
+	connectResultHostUnreachable
+	connectResultRefused
+	connectResultTTLExpired
 )
 
 var (
 	errDatagramMalformed = errors.New("datagram is malformed")
 )
 
-var datagramHeaderLenEncoded = newDatagram(0, 0, 0, nil).LenEncoded()
-var deviceID = dgDev(time.Now().UnixMilli())
+var datagramHeaderLenEncoded = newDatagram(0, 0, 0, 0, nil).LenEncoded()
+
+var (
+	lastDeviceID   dgDev
+	lastDeviceIDMu sync.Mutex
+)
+
+// Device ID is start time in milliseconds. Tunnels of one process
+// start at once, so the ID is bumped to keep it unique.
+func newDeviceID() dgDev {
+	lastDeviceIDMu.Lock()
+	defer lastDeviceIDMu.Unlock()
+
+	lastDeviceID = max(lastDeviceID+1, dgDev(time.Now().UnixMilli()))
+
+	return lastDeviceID
+}
 
+// Key ID was high byte of version before keys, so datagrams
+// encrypted with session.secret are the same as before.
 type datagram struct {
+	key      dgKey
 	version  dgVer
 	checksum dgSum
 	device   dgDev
@@ -51,8 +93,8 @@ func (dg datagram) String() string {
 	devShort := dg.device % 1000
 
 	return fmt.Sprintf(
-		"ver=%v sum=%v dev=%v ses=%v num=%v cmd=%v pld=%v",
-		dg.version, sumShort, devShort, dg.session, dg.number, dg.command, len(dg.payload),
+		"key=%v ver=%v sum=%v dev=%v ses=%v num=%v cmd=%v pld=%v",
+		dg.key, dg.version, sumShort, devShort, dg.session, dg.number, dg.command, len(dg.payload),
 	)
 }
 
@@ -64,8 +106,8 @@ func (dg datagram) LenEncoded() int {
 	return 5 * int(math.Ceil(float64(dg.Len())/4))
 }
 
-func (dg datagram) isLoopback() bool {
-	return dg.device == deviceID
+func (dg datagram) isLoopback(device dgDev) bool {
+	return dg.device == device
 }
 
 func (dg datagram) isZero() bool {
@@ -90,11 +132,11 @@ func datagramCalcMaxLen(maxLenEncoded int) int {
 	return int(math.Ceil(min))
 }
 
-func newDatagram(ses dgSes, num dgNum, cmd dgCmd, pld []byte) datagram {
+func newDatagram(dev dgDev, ses dgSes, num dgNum, cmd dgCmd, pld []byte) datagram {
 	return datagram{
-		version:  1,
+		version:  datagramVersion,
 		checksum: 0,
-		device:   deviceID,
+		device:   dev,
 		session:  ses,
 		number:   num,
 		command:  cmd,
@@ -105,7 +147,7 @@ func newDatagram(ses dgSes, num dgNum, cmd dgCmd, pld []byte) datagram {
 func encodeDatagram(dg datagram, enc int) string {
 	data := make([]byte, 0, dg.Len())
 
-	data = binary.BigEndian.AppendUint16(data, uint16(dg.version))
+	data = append(data, byte(dg.key), byte(dg.version))
 	data = binary.BigEndian.AppendUint32(data, uint32(dg.checksum))
 	data = binary.BigEndian.AppendUint64(data, uint64(dg.device))
 	data = binary.BigEndian.AppendUint32(data, uint32(dg.session))
@@ -132,7 +174,8 @@ func decodeDatagram(s string) (datagram, error) {
 		return datagram{}, errDatagramMalformed
 	}
 
-	ver := binary.BigEndian.Uint16(data[0:2])
+	key := data[0]
+	ver := data[1]
 	sum := binary.BigEndian.Uint32(data[2:6])
 	dev := binary.BigEndian.Uint64(data[6:14])
 	ses := binary.BigEndian.Uint32(data[14:18])
@@ -148,6 +191,7 @@ func decodeDatagram(s string) (datagram, error) {
 	}
 
 	dg := datagram{
+		key:      dgKey(key),
 		version:  dgVer(ver),
 		checksum: dgSum(sum),
 		device:   dgDev(dev),
@@ -205,6 +249,93 @@ func (pld *payloadRetry) decode(data []byte) error {
 	return nil
 }
 
+type payloadConnectResult struct {
+	result byte
+}
+
+func (pld *payloadConnectResult) encode() []byte {
+	return []byte{pld.result}
+}
+
+func (pld *payloadConnectResult) decode(data []byte) error {
+	if len(data) < 1 {
+		return errDatagramMalformed
+	}
+
+	pld.result = data[0]
+
+	return nil
+}
+
+type payloadResolve struct {
+	name  string
+	qtype uint16
+}
+
+func (pld *payloadResolve) encode() []byte {
+	data := []byte(pld.name)
+	data = binary.BigEndian.AppendUint16(data, pld.qtype)
+
+	return data
+}
+
+func (pld *payloadResolve) decode(data []byte) error {
+	if len(data) < 2 {
+		return errDatagramMalformed
+	}
+
+	pld.name = string(data[:len(data)-2])
+	pld.qtype = binary.BigEndian.Uint16(data[len(data)-2:])
+
+	return nil
+}
+
+type payloadResolveResult struct {
+	rcode byte
+	ips   []net.IP
+}
+
+func (pld *payloadResolveResult) encode() []byte {
+	data := []byte{pld.rcode}
+
+	for _, ip := range pld.ips {
+		if ip4 := ip.To4(); ip4 != nil {
+			ip = ip4
+		}
+
+		data = append(data, byte(len(ip)))
+		data = append(data, ip...)
+	}
+
+	return data
+}
+
+func (pld *payloadResolveResult) decode(data []byte) error {
+	if len(data) < 1 {
+		return errDatagramMalformed
+	}
+
+	pld.rcode = data[0]
+	pld.ips = nil
+
+	for i := 1; i < len(data); {
+		n := int(data[i])
+
+		if n != net.IPv4len && n != net.IPv6len {
+			return errDatagramMalformed
+		}
+
+		if i+1+n > len(data) {
+			return errDatagramMalformed
+		}
+
+		pld.ips = append(pld.ips, net.IP(bytes.Clone(data[i+1:i+1+n])))
+		i += 1 + n
+	}
+
+	return nil
+}
+
 const (
 	datagramEncodingASCII = iota + 1
 	datagramEncodingRU
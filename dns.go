@@ -0,0 +1,515 @@
+package main
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	dnsTypeA    uint16 = 1
+	dnsTypeAAAA uint16 = 28
+	dnsTypeOPT  uint16 = 41
+	dnsClassIN  uint16 = 1
+)
+
+const (
+	dnsRcodeSuccess        byte = 0
+	dnsRcodeServerFailure  byte = 2
+	dnsRcodeNameError      byte = 3
+	dnsRcodeNotImplemented byte = 4
+)
+
+const dnsHeaderLen = 12
+
+const (
+	dnsUDPSize       = 512
+	dnsTCPSize       = 65535
+	dnsCacheSize     = 10000
+	dnsFlagTruncated = 0x0200
+)
+
+var errDNSMalformed = errors.New("dns message is malformed")
+
+func listenDNS(ctx context.Context, t *tunnel, cfg config) error {
+	addr := address{cfg.DNSServer.Host, cfg.DNSServer.Port}.String()
+	pc, err := net.ListenPacket("udp", addr)
+
+	if err != nil {
+		return err
+	}
+
+	ln, err := net.Listen("tcp", addr)
+
+	if err != nil {
+		pc.Close()
+		return err
+	}
+
+	go func() {
+		<-ctx.Done()
+		pc.Close()
+		ln.Close()
+	}()
+
+	t.logger().Info("dns: listening", "addr", addr)
+
+	var wg sync.WaitGroup
+
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		serveDNSUDP(ctx, t, cfg, pc)
+	}()
+
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		serveDNSTCP(ctx, t, cfg, ln)
+	}()
+
+	wg.Wait()
+
+	return nil
+}
+
+func serveDNSUDP(ctx context.Context, t *tunnel, cfg config, pc net.PacketConn) {
+	buf := make([]byte, 64*1024)
+
+	for {
+		n, peer, err := pc.ReadFrom(buf)
+
+		if err != nil {
+			if ctx.Err() != nil {
+				return
+			}
+
+			t.logger().Error("dns: read", "err", err)
+			continue
+		}
+
+		query := append([]byte(nil), buf[:n]...)
+
+		go func() {
+			resp, err := handleDNSQuery(t, cfg, query, true)
+
+			if err != nil {
+				t.logger().Error("dns: query", "peer", peer.String(), "err", err)
+				return
+			}
+
+			if _, err := pc.WriteTo(resp, peer); err != nil {
+				t.logger().Error("dns: write", "peer", peer.String(), "err", err)
+			}
+		}()
+	}
+}
+
+func serveDNSTCP(ctx context.Context, t *tunnel, cfg config, ln net.Listener) {
+	for {
+		conn, err := ln.Accept()
+
+		if err != nil {
+			if ctx.Err() != nil {
+				return
+			}
+
+			t.logger().Error("dns: accept", "err", err)
+			continue
+		}
+
+		go func() {
+			defer conn.Close()
+
+			if err := handleDNSConn(t, cfg, conn); err != nil {
+				t.logger().Error("dns: conn", "peer", conn.RemoteAddr().String(), "err", err)
+			}
+		}()
+	}
+}
+
+func handleDNSConn(t *tunnel, cfg config, conn net.Conn) error {
+	for {
+		if err := conn.SetReadDeadline(time.Now().Add(cfg.DNSServer.Timeout())); err != nil {
+			return err
+		}
+
+		size := make([]byte, 2)
+
+		if _, err := io.ReadFull(conn, size); err != nil {
+			if errors.Is(err, io.EOF) {
+				return nil
+			}
+
+			return err
+		}
+
+		query := make([]byte, binary.BigEndian.Uint16(size))
+
+		if _, err := io.ReadFull(conn, query); err != nil {
+			return err
+		}
+
+		resp, err := handleDNSQuery(t, cfg, query, false)
+
+		if err != nil {
+			return err
+		}
+
+		out := binary.BigEndian.AppendUint16(nil, uint16(len(resp)))
+		out = append(out, resp...)
+
+		if _, err := conn.Write(out); err != nil {
+			return err
+		}
+	}
+}
+
+// UDP response is limited by 512 bytes or by EDNS size of the query.
+func handleDNSQuery(t *tunnel, cfg config, query []byte, udp bool) ([]byte, error) {
+	q, err := parseDNSQuestion(query)
+
+	if err != nil {
+		return nil, err
+	}
+
+	size := dnsTCPSize
+
+	if udp {
+		size = dnsEDNSSize(query, q)
+	}
+
+	if q.qclass != dnsClassIN || (q.qtype != dnsTypeA && q.qtype != dnsTypeAAAA) {
+		return buildDNSResponse(query, q, dnsRcodeNotImplemented, nil, 0, size), nil
+	}
+
+	ttl := cfg.DNSServer.CacheTTL()
+
+	if entry, exists := t.getDNSCache(q.name, q.qtype); exists {
+		remaining := time.Until(entry.expires)
+		return buildDNSResponse(query, q, entry.rcode, entry.ips, uint32(remaining.Seconds()), size), nil
+	}
+
+	res, err := resolveSession(t, cfg, q.name, q.qtype)
+
+	if err != nil {
+		t.logger().Error("dns: resolve", "name", q.name, "qtype", q.qtype, "err", err)
+		return buildDNSResponse(query, q, dnsRcodeServerFailure, nil, 0, size), nil
+	}
+
+	if res.rcode == dnsRcodeSuccess || res.rcode == dnsRcodeNameError {
+		t.setDNSCache(q.name, q.qtype, res, ttl)
+	}
+
+	return buildDNSResponse(query, q, res.rcode, res.ips, uint32(ttl.Seconds()), size), nil
+}
+
+func resolveSession(t *tunnel, cfg config, name string, qtype uint16) (payloadResolveResult, error) {
+	ses, err := openSession(t, t.nextSessionID())
+
+	if err != nil {
+		return payloadResolveResult{}, err
+	}
+
+	t.setSession(ses.id, ses)
+
+	defer func() {
+		ses.sendDatagram(newDatagram(t.device, 0, 0, commandClose, nil))
+		go ses.close()
+	}()
+
+	pld := payloadResolve{
+		name:  name,
+		qtype: qtype,
+	}
+	key, encrypted, err := t.loadKeys().seal(pld.encode())
+
+	if err != nil {
+		return payloadResolveResult{}, err
+	}
+
+	dg := newDatagram(t.device, 0, 0, commandResolve, encrypted)
+	dg.key = key
+
+	if err := ses.sendDatagram(dg); err != nil {
+		return payloadResolveResult{}, err
+	}
+
+	ses.logger().Debug("dns: resolve", "name", name, "qtype", qtype)
+
+	return ses.waitResolveResult(cfg.DNSServer.Timeout())
+}
+
+func resolveName(name string, qtype uint16) payloadResolveResult {
+	network := "ip4"
+
+	if qtype == dnsTypeAAAA {
+		network = "ip6"
+	} else if qtype != dnsTypeA {
+		return payloadResolveResult{rcode: dnsRcodeNotImplemented}
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	ips, err := net.DefaultResolver.LookupIP(ctx, network, name)
+
+	if err != nil {
+		var dnsErr *net.DNSError
+
+		if errors.As(err, &dnsErr) && dnsErr.IsNotFound {
+			return payloadResolveResult{rcode: dnsRcodeNameError}
+		}
+
+		return payloadResolveResult{rcode: dnsRcodeServerFailure}
+	}
+
+	return payloadResolveResult{
+		rcode: dnsRcodeSuccess,
+		ips:   ips,
+	}
+}
+
+type dnsQuestion struct {
+	name   string
+	qtype  uint16
+	qclass uint16
+	raw    []byte
+}
+
+func parseDNSQuestion(msg []byte) (dnsQuestion, error) {
+	if len(msg) < dnsHeaderLen {
+		return dnsQuestion{}, errDNSMalformed
+	}
+
+	flags := binary.BigEndian.Uint16(msg[2:4])
+	qdcount := binary.BigEndian.Uint16(msg[4:6])
+
+	if flags&0x8000 != 0 || qdcount != 1 {
+		return dnsQuestion{}, errDNSMalformed
+	}
+
+	labels := []string{}
+	offset := dnsHeaderLen
+
+	for {
+		if offset >= len(msg) {
+			return dnsQuestion{}, errDNSMalformed
+		}
+
+		n := int(msg[offset])
+		offset++
+
+		if n == 0 {
+			break
+		}
+
+		if n&0xc0 != 0 || offset+n > len(msg) {
+			return dnsQuestion{}, errDNSMalformed
+		}
+
+		labels = append(labels, string(msg[offset:offset+n]))
+		offset += n
+	}
+
+	if offset+4 > len(msg) {
+		return dnsQuestion{}, errDNSMalformed
+	}
+
+	q := dnsQuestion{
+		name:   strings.Join(labels, "."),
+		qtype:  binary.BigEndian.Uint16(msg[offset : offset+2]),
+		qclass: binary.BigEndian.Uint16(msg[offset+2 : offset+4]),
+		raw:    msg[dnsHeaderLen : offset+4],
+	}
+
+	return q, nil
+}
+
+// Answers that don't fit into size are cut and TC bit is set,
+// so the client retries over TCP.
+func buildDNSResponse(query []byte, q dnsQuestion, rcode byte, ips []net.IP, ttl uint32, size int) []byte {
+	answers := []net.IP{}
+	length := dnsHeaderLen + len(q.raw)
+	truncated := false
+
+	for _, ip := range ips {
+		ip4 := ip.To4()
+
+		if q.qtype == dnsTypeA && ip4 != nil {
+			ip = ip4
+		} else if q.qtype != dnsTypeAAAA || ip4 != nil || len(ip) != net.IPv6len {
+			continue
+		}
+
+		if length+12+len(ip) > size {
+			truncated = true
+			break
+		}
+
+		answers = append(answers, ip)
+		length += 12 + len(ip)
+	}
+
+	flags := binary.BigEndian.Uint16(query[2:4])
+	flags = 0x8000 | flags&0x7900 | 0x0080 | uint16(rcode)
+
+	if truncated {
+		flags |= dnsFlagTruncated
+	}
+
+	msg := make([]byte, 0, dnsHeaderLen+len(q.raw)+len(answers)*28)
+	msg = append(msg, query[0:2]...)
+	msg = binary.BigEndian.AppendUint16(msg, flags)
+	msg = binary.BigEndian.AppendUint16(msg, 1)
+	msg = binary.BigEndian.AppendUint16(msg, uint16(len(answers)))
+	msg = binary.BigEndian.AppendUint16(msg, 0)
+	msg = binary.BigEndian.AppendUint16(msg, 0)
+	msg = append(msg, q.raw...)
+
+	for _, ip := range answers {
+		msg = binary.BigEndian.AppendUint16(msg, 0xc000|dnsHeaderLen)
+		msg = binary.BigEndian.AppendUint16(msg, q.qtype)
+		msg = binary.BigEndian.AppendUint16(msg, dnsClassIN)
+		msg = binary.BigEndian.AppendUint32(msg, ttl)
+		msg = binary.BigEndian.AppendUint16(msg, uint16(len(ip)))
+		msg = append(msg, ip...)
+	}
+
+	return msg
+}
+
+// Size is taken from OPT record in additional section of the query.
+func dnsEDNSSize(query []byte, q dnsQuestion) int {
+	ancount := binary.BigEndian.Uint16(query[6:8])
+	nscount := binary.BigEndian.Uint16(query[8:10])
+	arcount := binary.BigEndian.Uint16(query[10:12])
+	offset := dnsHeaderLen + len(q.raw)
+
+	if ancount != 0 || nscount != 0 {
+		return dnsUDPSize
+	}
+
+	for range arcount {
+		// OPT record has root name, other records are skipped by their names.
+		for offset < len(query) && query[offset] != 0 {
+			if query[offset]&0xc0 == 0xc0 {
+				offset++
+				break
+			}
+
+			offset += int(query[offset]) + 1
+		}
+
+		offset++
+
+		if offset+10 > len(query) {
+			return dnsUDPSize
+		}
+
+		rrtype := binary.BigEndian.Uint16(query[offset : offset+2])
+		class := binary.BigEndian.Uint16(query[offset+2 : offset+4])
+		rdlen := binary.BigEndian.Uint16(query[offset+8 : offset+10])
+
+		if rrtype == dnsTypeOPT {
+			return max(int(class), dnsUDPSize)
+		}
+
+		offset += 10 + int(rdlen)
+	}
+
+	return dnsUDPSize
+}
+
+type dnsCacheEntry struct {
+	rcode   byte
+	ips     []net.IP
+	expires time.Time
+}
+
+func dnsCacheKey(name string, qtype uint16) string {
+	return fmt.Sprintf("%v/%v", strings.ToLower(name), qtype)
+}
+
+func (t *tunnel) getDNSCache(name string, qtype uint16) (dnsCacheEntry, bool) {
+	t.dnsCacheMu.Lock()
+	defer t.dnsCacheMu.Unlock()
+
+	key := dnsCacheKey(name, qtype)
+	entry, exists := t.dnsCache[key]
+
+	if !exists {
+		return dnsCacheEntry{}, false
+	}
+
+	if time.Now().After(entry.expires) {
+		delete(t.dnsCache, key)
+		return dnsCacheEntry{}, false
+	}
+
+	return entry, true
+}
+
+func (t *tunnel) setDNSCache(name string, qtype uint16, res payloadResolveResult, ttl time.Duration) {
+	if ttl == 0 {
+		return
+	}
+
+	t.dnsCacheMu.Lock()
+	defer t.dnsCacheMu.Unlock()
+
+	if len(t.dnsCache) >= dnsCacheSize {
+		t.deleteExpiredDNSCacheLocked()
+	}
+
+	if len(t.dnsCache) >= dnsCacheSize {
+		t.deleteSoonestDNSCacheLocked()
+	}
+
+	t.dnsCache[dnsCacheKey(name, qtype)] = dnsCacheEntry{
+		rcode:   res.rcode,
+		ips:     res.ips,
+		expires: time.Now().Add(ttl),
+	}
+}
+
+func (t *tunnel) deleteExpiredDNSCache() int {
+	t.dnsCacheMu.Lock()
+	defer t.dnsCacheMu.Unlock()
+
+	return t.deleteExpiredDNSCacheLocked()
+}
+
+func (t *tunnel) deleteExpiredDNSCacheLocked() int {
+	now := time.Now()
+	n := 0
+
+	for key, entry := range t.dnsCache {
+		if now.After(entry.expires) {
+			delete(t.dnsCache, key)
+			n++
+		}
+	}
+
+	return n
+}
+
+func (t *tunnel) deleteSoonestDNSCacheLocked() {
+	soonest := ""
+	expires := time.Time{}
+
+	for key, entry := range t.dnsCache {
+		if len(soonest) == 0 || entry.expires.Before(expires) {
+			soonest = key
+			expires = entry.expires
+		}
+	}
+
+	delete(t.dnsCache, soonest)
+}
@@ -0,0 +1,104 @@
+package main
+
+import (
+	"encoding/binary"
+	"net"
+	"testing"
+	"time"
+)
+
+func testDNSQuery(ednsSize uint16) []byte {
+	msg := []byte{0x12, 0x34, 0x01, 0x00, 0, 1, 0, 0, 0, 0, 0, 0}
+	msg = append(msg, 7, 'e', 'x', 'a', 'm', 'p', 'l', 'e', 3, 'c', 'o', 'm', 0)
+	msg = binary.BigEndian.AppendUint16(msg, dnsTypeA)
+	msg = binary.BigEndian.AppendUint16(msg, dnsClassIN)
+
+	if ednsSize > 0 {
+		binary.BigEndian.PutUint16(msg[10:12], 1)
+		msg = append(msg, 0)
+		msg = binary.BigEndian.AppendUint16(msg, dnsTypeOPT)
+		msg = binary.BigEndian.AppendUint16(msg, ednsSize)
+		msg = binary.BigEndian.AppendUint32(msg, 0)
+		msg = binary.BigEndian.AppendUint16(msg, 0)
+	}
+
+	return msg
+}
+
+func TestDNSResponseTruncate(t *testing.T) {
+	ips := []net.IP{}
+
+	for i := range 100 {
+		ips = append(ips, net.IPv4(10, 0, 0, byte(i)))
+	}
+
+	tests := []struct {
+		name      string
+		ednsSize  uint16
+		udp       bool
+		truncated bool
+	}{
+		{"udp", 0, true, true},
+		{"udp edns", 4096, true, false},
+		{"udp small edns", 100, true, true},
+		{"tcp", 0, false, false},
+	}
+
+	for _, tt := range tests {
+		query := testDNSQuery(tt.ednsSize)
+		q, err := parseDNSQuestion(query)
+
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		size := dnsTCPSize
+
+		if tt.udp {
+			size = dnsEDNSSize(query, q)
+		}
+
+		resp := buildDNSResponse(query, q, dnsRcodeSuccess, ips, 60, size)
+		flags := binary.BigEndian.Uint16(resp[2:4])
+		ancount := int(binary.BigEndian.Uint16(resp[6:8]))
+
+		if got := flags&dnsFlagTruncated != 0; got != tt.truncated {
+			t.Fatalf("%v: got truncated %v, want %v", tt.name, got, tt.truncated)
+		}
+
+		if len(resp) > size {
+			t.Fatalf("%v: got %v bytes, want at most %v", tt.name, len(resp), size)
+		}
+
+		if len(resp) != dnsHeaderLen+len(q.raw)+ancount*16 {
+			t.Fatalf("%v: got %v bytes for %v answers", tt.name, len(resp), ancount)
+		}
+
+		if !tt.truncated && ancount != len(ips) {
+			t.Fatalf("%v: got %v answers, want %v", tt.name, ancount, len(ips))
+		}
+	}
+}
+
+func TestDNSCacheEvictsSoonest(t *testing.T) {
+	tun := newTunnel("")
+	res := payloadResolveResult{rcode: dnsRcodeSuccess}
+
+	for i := range dnsCacheSize {
+		tun.setDNSCache(net.IPv4(10, 0, byte(i>>8), byte(i)).String(), dnsTypeA, res, time.Hour+time.Duration(i)*time.Second)
+	}
+
+	tun.setDNSCache("example.com", dnsTypeA, res, 2*time.Hour)
+
+	if len(tun.dnsCache) != dnsCacheSize {
+		t.Fatalf("got %v entries, want %v", len(tun.dnsCache), dnsCacheSize)
+	}
+
+	if _, exists := tun.getDNSCache("10.0.0.0", dnsTypeA); exists {
+		t.Fatal("entry expiring soonest is kept")
+	}
+
+	if _, exists := tun.getDNSCache("10.0.0.1", dnsTypeA); !exists {
+		t.Fatal("other entries are evicted")
+	}
+}
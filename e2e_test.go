@@ -0,0 +1,216 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"maps"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/srgykuz/vk-proxy/vktest"
+)
+
+const testConfigEnv = "VK_PROXY_TEST_CONFIG"
+
+// Both ends of the tunnel must be separate processes with own
+// device IDs, so test binary runs main when started by startProxy.
+func TestMain(m *testing.M) {
+	if path := os.Getenv(testConfigEnv); len(path) > 0 {
+		os.Args = []string{os.Args[0], "-config", path}
+		main()
+	}
+
+	os.Exit(m.Run())
+}
+
+func TestEndToEnd(t *testing.T) {
+	if testing.Short() {
+		t.Skip("skipping in short mode")
+	}
+
+	// Servers are closed after proxies, otherwise Close waits for long polls.
+	vk := vktest.NewServer()
+	t.Cleanup(vk.Close)
+
+	vk.AddClub("100", "token100")
+	vk.AddUser("200", "token200")
+
+	target, body := startTarget(t)
+	secret := testSecret(t)
+	ports := [2]int{}
+
+	for i := range ports {
+		ports[i] = freePort(t)
+
+		cfg := testConfig(vk)
+		maps.Copy(cfg, map[string]any{
+			"session": map[string]any{"secret": secret},
+			"socks":   map[string]any{"port": ports[i]},
+			"clubs":   []any{testClub("club", "100", "token100")},
+		})
+		startProxy(t, writeTestConfig(t, cfg))
+
+		// Datagrams sent before the interlocutor gets long poll server
+		// are lost. Waiting also keeps device IDs, which are start time
+		// in milliseconds, different.
+		waitCalls(t, vk, "groups.getLongPollServer", i+1)
+	}
+
+	for i, port := range ports {
+		got, err := fetchSocks(port, target.URL)
+
+		if err != nil {
+			t.Fatalf("proxy %v: %v", i, err)
+		}
+
+		if !bytes.Equal(got, body) {
+			t.Fatalf("proxy %v: got %v bytes, want %v", i, len(got), len(body))
+		}
+	}
+}
+
+func startTarget(t *testing.T) (*httptest.Server, []byte) {
+	body := bytes.Repeat([]byte("vk-proxy "), 4000)
+	target := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write(body)
+	}))
+	t.Cleanup(target.Close)
+
+	return target, body
+}
+
+func testSecret(t *testing.T) string {
+	secret, err := generateSecret()
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return secret
+}
+
+func testClub(name, id, token string) map[string]any {
+	return map[string]any{
+		"name":        name,
+		"id":          id,
+		"accessToken": token,
+		"albumID":     "1",
+		"photoID":     "2",
+		"videoID":     "3",
+		"marketID":    "4",
+	}
+}
+
+// Target is served on loopback, so ACL must allow private addresses.
+func testConfig(vk *vktest.Server) map[string]any {
+	return map[string]any{
+		"api": map[string]any{
+			"url": vk.APIURL(),
+			"tls": map[string]any{"insecure": true},
+		},
+		"qr":  map[string]any{"zbarPath": ""},
+		"acl": map[string]any{"allowPrivate": true},
+		"users": []any{
+			map[string]any{"name": "user", "id": "200", "accessToken": "token200"},
+		},
+	}
+}
+
+func writeTestConfig(t *testing.T, cfg map[string]any) string {
+	data, err := json.Marshal(cfg)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	path := filepath.Join(t.TempDir(), "config.json")
+
+	if err := os.WriteFile(path, data, 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	return path
+}
+
+func startProxy(t *testing.T, cfgPath string) {
+	out := &bytes.Buffer{}
+	cmd := exec.Command(os.Args[0], "-test.run=^$")
+	cmd.Env = append(os.Environ(), testConfigEnv+"="+cfgPath)
+	cmd.Stdout = out
+	cmd.Stderr = out
+
+	if err := cmd.Start(); err != nil {
+		t.Fatal(err)
+	}
+
+	t.Cleanup(func() {
+		cmd.Process.Kill()
+		cmd.Wait()
+
+		if t.Failed() {
+			t.Logf("proxy output:\n%s", out)
+		}
+	})
+}
+
+func waitCalls(t *testing.T, vk *vktest.Server, method string, n int) {
+	deadline := time.Now().Add(30 * time.Second)
+
+	for vk.Calls(method) < n {
+		if time.Now().After(deadline) {
+			t.Fatalf("%v: got %v calls, want %v", method, vk.Calls(method), n)
+		}
+
+		time.Sleep(100 * time.Millisecond)
+	}
+}
+
+func freePort(t *testing.T) int {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer ln.Close()
+
+	return ln.Addr().(*net.TCPAddr).Port
+}
+
+// Proxy may still be starting, so request is repeated until deadline.
+func fetchSocks(port int, uri string) ([]byte, error) {
+	client := &http.Client{
+		Transport: &http.Transport{
+			Proxy: http.ProxyURL(&url.URL{
+				Scheme: "socks5",
+				Host:   fmt.Sprintf("127.0.0.1:%v", port),
+			}),
+		},
+		Timeout: 30 * time.Second,
+	}
+	deadline := time.Now().Add(60 * time.Second)
+
+	for {
+		resp, err := client.Get(uri)
+
+		if err == nil {
+			defer resp.Body.Close()
+			return io.ReadAll(resp.Body)
+		}
+
+		if time.Now().After(deadline) {
+			return nil, err
+		}
+
+		time.Sleep(500 * time.Millisecond)
+	}
+}
@@ -0,0 +1,57 @@
+package main
+
+import (
+	"log/slog"
+	"math/rand"
+	"time"
+)
+
+type fault struct {
+	copies int
+	delay  time.Duration
+}
+
+func injectFault(cfg configFault) fault {
+	f := fault{
+		copies: 1,
+	}
+
+	if !cfg.isEnabled() {
+		return f
+	}
+
+	if rand.Float64() < cfg.Drop {
+		f.copies = 0
+		return f
+	}
+
+	if rand.Float64() < cfg.Duplicate {
+		f.copies = 2
+	}
+
+	if rand.Float64() < cfg.Delay {
+		f.delay += cfg.DelayTime()
+	}
+
+	if rand.Float64() < cfg.Reorder {
+		f.delay += time.Duration(rand.Int63n(int64(cfg.ReorderTime())))
+	}
+
+	return f
+}
+
+func runWithFault(cfg configFault, dg datagram, run func()) {
+	f := injectFault(cfg)
+
+	if f.copies != 1 || f.delay > 0 {
+		slog.Debug("fault: inject", "copies", f.copies, "delay", f.delay, "dg", dg)
+	}
+
+	if f.copies > 0 && f.delay > 0 {
+		time.Sleep(f.delay)
+	}
+
+	for range f.copies {
+		run()
+	}
+}
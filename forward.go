@@ -0,0 +1,80 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net"
+)
+
+var errReverseDenied = errors.New("not listed in reverse forwards")
+
+func listenForward(ctx context.Context, t *tunnel, cfg config, fwd configForward) error {
+	target, err := parseAddress(fwd.Target)
+
+	if err != nil {
+		return err
+	}
+
+	ln, err := net.Listen("tcp", fwd.Listen)
+
+	if err != nil {
+		return err
+	}
+
+	go func() {
+		<-ctx.Done()
+		ln.Close()
+	}()
+
+	t.logger().Info("forward: listening", "addr", fwd.Listen, "target", target)
+
+	for {
+		conn, err := ln.Accept()
+
+		if err != nil {
+			if ctx.Err() != nil {
+				return nil
+			}
+
+			t.logger().Error("forward: accept", "addr", fwd.Listen, "err", err)
+			continue
+		}
+
+		ses, err := openSession(t, t.nextSessionID())
+
+		if err != nil {
+			t.logger().Error("forward: session", "err", err)
+			conn.Close()
+			continue
+		}
+
+		ses.setPeer(conn)
+		t.setSession(ses.id, ses)
+
+		cmd := commandConnect
+
+		if fwd.Reverse {
+			cmd = commandConnectReverse
+		}
+
+		go acceptTarget(cfg, ses, target, cmd)
+	}
+}
+
+// Interlocutor may open only targets of reverse forwards without listen,
+// so device without them denies every reverse connect.
+func checkReverse(forwards []configForward, addr address) error {
+	for _, fwd := range forwards {
+		if !fwd.Reverse || len(fwd.Listen) > 0 {
+			continue
+		}
+
+		target, err := parseAddress(fwd.Target)
+
+		if err == nil && target == addr {
+			return nil
+		}
+	}
+
+	return errReverseDenied
+}
@@ -0,0 +1,31 @@
+package main
+
+import (
+	"errors"
+	"testing"
+)
+
+func TestCheckReverse(t *testing.T) {
+	forwards := []configForward{
+		{Listen: "127.0.0.1:2222", Target: "127.0.0.1:2223", Reverse: true},
+		{Listen: "127.0.0.1:1993", Target: "imap.example.com:993"},
+		{Target: "127.0.0.1:22", Reverse: true},
+	}
+
+	tests := []struct {
+		forwards []configForward
+		addr     address
+		err      error
+	}{
+		{forwards, address{"127.0.0.1", 22}, nil},
+		{forwards, address{"127.0.0.1", 2223}, errReverseDenied},
+		{forwards, address{"imap.example.com", 993}, errReverseDenied},
+		{nil, address{"127.0.0.1", 22}, errReverseDenied},
+	}
+
+	for _, tt := range tests {
+		if err := checkReverse(tt.forwards, tt.addr); !errors.Is(err, tt.err) {
+			t.Fatalf("%v: got %v, want %v", tt.addr, err, tt.err)
+		}
+	}
+}
@@ -4,17 +4,18 @@ import (
 	"context"
 	"errors"
 	"fmt"
-	"log/slog"
+	"math"
 	"net"
 	"net/url"
 	"os"
 	"sort"
 	"strings"
 	"sync"
+	"syscall"
 	"time"
 )
 
-func listenLongPoll(ctx context.Context, cfg config, club configClub) error {
+func listenLongPoll(ctx context.Context, t *tunnel, cfg config, club configClub) error {
 	server, err := groupsGetLongPollServer(cfg.API, club)
 
 	if err != nil {
@@ -26,7 +27,7 @@ func listenLongPoll(ctx context.Context, cfg config, club configClub) error {
 		TS: server.TS,
 	}
 
-	slog.Info("long poll: listening", "club", club.Name)
+	t.logger().Info("long poll: listening", "club", club.Name)
 
 	for {
 		select {
@@ -36,13 +37,14 @@ func listenLongPoll(ctx context.Context, cfg config, club configClub) error {
 			last, err = groupsUseLongPollServer(ctx, cfg.API, server, last)
 
 			if err != nil {
-				slog.Error("long poll: listen", "club", club.Name, "err", err)
+				t.logger().Error("long poll: listen", "club", club.Name, "err", err)
 				sleep = time.Second * 5
 				continue
 			}
 
 			if last.Failed != 0 {
-				slog.Debug("long poll: refresh", "club", club.Name)
+				t.logger().Debug("long poll: refresh", "club", club.Name)
+				metricLongPollReconnect.inc(t.name, club.Name)
 
 				server, err = groupsGetLongPollServer(cfg.API, club)
 
@@ -52,7 +54,7 @@ func listenLongPoll(ctx context.Context, cfg config, club configClub) error {
 					}
 					sleep = 0
 				} else {
-					slog.Error("long poll: refresh", "club", club.Name, "err", err)
+					t.logger().Error("long poll: refresh", "club", club.Name, "err", err)
 					sleep = time.Second * 5
 				}
 
@@ -61,8 +63,8 @@ func listenLongPoll(ctx context.Context, cfg config, club configClub) error {
 
 			for _, upd := range last.Updates {
 				go func(upd update) {
-					if err := handleUpdate(cfg, club, upd); err != nil {
-						slog.Error("handler: update", "club", club.Name, "type", upd.Type, "err", err)
+					if err := handleUpdate(t, t.loadConfig(), club, upd); err != nil {
+						t.logger().Error("handler: update", "club", club.Name, "type", upd.Type, "err", err)
 					}
 				}(upd)
 			}
@@ -72,7 +74,7 @@ func listenLongPoll(ctx context.Context, cfg config, club configClub) error {
 	}
 }
 
-func handleUpdate(cfg config, club configClub, upd update) error {
+func handleUpdate(t *tunnel, cfg config, club configClub, upd update) error {
 	var encodedS string
 	var encodedB []byte
 	var datagrams []datagram
@@ -88,8 +90,8 @@ func handleUpdate(cfg config, club configClub, upd update) error {
 	case updateTypePhotoNew:
 		if strings.HasPrefix(upd.Object.Text, "https://") {
 			encodedS = upd.Object.Text
-		} else if shouldHandlePhoto(upd.Object.Text) {
-			datagrams, err = handlePhoto(cfg.API, cfg.QR, upd.Object.OrigPhoto.URL)
+		} else if shouldHandlePhoto(t, upd.Object.Text) {
+			datagrams, err = handlePhoto(t, cfg.API, cfg.QR, upd.Object.OrigPhoto.URL)
 		} else {
 			encodedS = upd.Object.Text
 		}
@@ -118,7 +120,7 @@ func handleUpdate(cfg config, club configClub, upd update) error {
 	if strings.HasPrefix(encodedS, "https://") {
 		encodedS = strings.ReplaceAll(encodedS, ". ", ".")
 
-		if shouldHandleDoc(encodedS) {
+		if shouldHandleDoc(t, encodedS) {
 			uri := clearDocURL(encodedS)
 			encodedB, err = apiDownloadURL(cfg.API, uri)
 		}
@@ -135,7 +137,7 @@ func handleUpdate(cfg config, club configClub, upd update) error {
 	}
 
 	if len(encodedS) > 0 {
-		dg, err := handleEncoded(encodedS)
+		dg, err := handleEncoded(t, encodedS)
 
 		if err != nil {
 			return err
@@ -147,22 +149,28 @@ func handleUpdate(cfg config, club configClub, upd update) error {
 	}
 
 	for _, dg := range datagrams {
-		slog.Debug("handler: update", "club", club.Name, "type", upd.Type, "dg", dg)
+		t.logger().Debug("handler: update", "club", club.Name, "type", upd.Type, "dg", dg)
+		metricDatagramsReceived.inc(t.name, upd.Type, club.Name)
 
-		if err := handleDatagram(cfg, dg); err != nil {
-			slog.Error("handler: update", "club", club.Name, "type", upd.Type, "dg", dg, "err", err)
-		}
+		runWithFault(cfg.Faults.Receive, dg, func() {
+			err := handleDatagram(t, club, dg)
+			traceReceive(t, dg, upd.Type, club, err)
+
+			if err != nil {
+				t.logger().Error("handler: update", "club", club.Name, "type", upd.Type, "dg", dg, "err", err)
+			}
+		})
 	}
 
 	return nil
 }
 
-func shouldHandlePhoto(caption string) bool {
+func shouldHandlePhoto(t *tunnel, caption string) bool {
 	if len(caption) == 0 {
 		return true
 	}
 
-	dg, err := handleEncoded(caption)
+	dg, err := handleEncoded(t, caption)
 
 	if err != nil {
 		return true
@@ -173,7 +181,7 @@ func shouldHandlePhoto(caption string) bool {
 	return isMethodQR
 }
 
-func shouldHandleDoc(uri string) bool {
+func shouldHandleDoc(t *tunnel, uri string) bool {
 	parsed, err := url.Parse(uri)
 
 	if err != nil {
@@ -186,7 +194,7 @@ func shouldHandleDoc(uri string) bool {
 		return true
 	}
 
-	dg, err := handleEncoded(caption)
+	dg, err := handleEncoded(t, caption)
 
 	if err != nil {
 		return true
@@ -210,7 +218,7 @@ func clearDocURL(uri string) string {
 	return parsed.String()
 }
 
-func handlePhoto(cfgAPI configAPI, cfgQR configQR, url string) ([]datagram, error) {
+func handlePhoto(t *tunnel, cfgAPI configAPI, cfgQR configQR, url string) ([]datagram, error) {
 	b, err := apiDownloadURL(cfgAPI, url)
 
 	if err != nil {
@@ -234,7 +242,7 @@ func handlePhoto(cfgAPI configAPI, cfgQR configQR, url string) ([]datagram, erro
 	datagrams := []datagram{}
 
 	for _, s := range content {
-		dg, err := handleEncoded(s)
+		dg, err := handleEncoded(t, s)
 
 		if err != nil {
 			return nil, err
@@ -252,51 +260,63 @@ func handlePhoto(cfgAPI configAPI, cfgQR configQR, url string) ([]datagram, erro
 	return datagrams, nil
 }
 
-func handleEncoded(s string) (datagram, error) {
+func handleEncoded(t *tunnel, s string) (datagram, error) {
 	dg, err := decodeDatagram(s)
 
 	if err != nil {
 		return datagram{}, fmt.Errorf("decode datagram: %v", err)
 	}
 
-	if dg.isLoopback() {
+	if dg.isLoopback(t.device) {
 		return datagram{}, nil
 	}
 
 	return dg, nil
 }
 
-var handleDatagramMu sync.Mutex = sync.Mutex{}
-var handleDatagramQueues map[dgSes]*handlerPriorityQueue = map[dgSes]*handlerPriorityQueue{}
+func handleDatagram(t *tunnel, club configClub, dg datagram) error {
+	t.queuesMu.Lock()
+	defer t.queuesMu.Unlock()
+
+	// Sessions opened by the interlocutor are stored with negated ID,
+	// so both peers can open sessions without collisions.
+	id := dg.session
 
-func handleDatagram(cfg config, dg datagram) error {
-	handleDatagramMu.Lock()
-	defer handleDatagramMu.Unlock()
+	if dg.version >= datagramVersionNegated {
+		if dg.session == math.MinInt32 {
+			return errDatagramMalformed
+		}
+
+		id = -dg.session
+	}
 
-	ses, exists := getSession(dg.session)
+	ses, exists := t.getSession(id)
 
-	if exists && ses.isClosed() && dg.command == commandConnect {
-		slog.Warn("handler: bidirectional proxying is not supported")
+	if exists && ses.isClosed() && (dg.command == commandConnect || dg.command == commandConnectReverse) {
+		ses.logger().Debug("handler: session id is reused")
 		exists = false
 	}
 
 	if !exists {
 		var err error
-		ses, err = openSession(dg.session, cfg)
+		ses, err = openSession(t, id)
 
 		if err != nil {
 			return fmt.Errorf("open session: %v", err)
 		}
 
-		setSession(ses.id, ses)
-		delete(handleDatagramQueues, ses.id)
+		ses.setClub(club)
+		t.setSession(ses.id, ses)
+		delete(t.queues, ses.id)
 	}
 
-	queue, exists := handleDatagramQueues[ses.id]
+	ses.setDevice(dg.device)
+
+	queue, exists := t.queues[ses.id]
 
 	if !exists {
-		queue = openHandlerPriorityQueue(cfg, ses)
-		handleDatagramQueues[ses.id] = queue
+		queue = openHandlerPriorityQueue(ses)
+		t.queues[ses.id] = queue
 	}
 
 	if err := queue.add(dg); err != nil {
@@ -307,20 +327,18 @@ func handleDatagram(cfg config, dg datagram) error {
 }
 
 func handleCommand(cfg config, ses *session, dg datagram) error {
-	slog.Debug("handler: command", "dg", dg)
+	ses.logger().Debug("handler: command", "dg", dg)
 
-	if cfg.Log.Payload {
-		slog.Debug("handler: payload", "ses", ses, "in", bytesToHex(dg.payload))
-	}
+	logPayload("handler: payload", ses, "in", dg.payload)
 
 	var err error
 
 	switch dg.command {
-	case commandConnect:
+	case commandConnect, commandConnectReverse:
 		err = handleConnect(cfg, ses, dg)
 
 		if err == nil {
-			slog.Info("handler: forwarding", "ses", ses)
+			ses.logger().Info("handler: forwarding")
 		}
 	case commandForward:
 		err = handleForward(ses, dg)
@@ -328,6 +346,12 @@ func handleCommand(cfg config, ses *session, dg datagram) error {
 		handleClose(ses)
 	case commandRetry:
 		err = handleRetry(ses, dg)
+	case commandConnectResult:
+		err = handleConnectResult(ses, dg)
+	case commandResolve:
+		err = handleResolve(ses, dg)
+	case commandResolveResult:
+		err = handleResolveResult(ses, dg)
 	default:
 		err = errors.New("unsupported")
 	}
@@ -340,33 +364,146 @@ func handleCommand(cfg config, ses *session, dg datagram) error {
 }
 
 func handleConnect(cfg config, ses *session, dg datagram) error {
-	decrypted, err := decrypt(dg.payload, cfg.Session.SecretKey)
+	decrypted, err := ses.tunnel.loadKeys().open(dg.key, dg.payload)
 
 	if err != nil {
+		sendConnectResult(ses, connectResultFailure)
 		return err
 	}
 
 	pld := payloadConnect{}
 
 	if err := pld.decode(decrypted); err != nil {
+		sendConnectResult(ses, connectResultFailure)
 		return err
 	}
 
-	addr := address(pld).String()
+	ses.setTarget(address(pld))
+
+	upstream := matchUpstream(cfg.Upstream, address(pld))
+	checked := address(pld)
+
+	// Reverse connect is checked only against reverse forwards,
+	// so their targets are allowed even if they are local.
+	if dg.command == commandConnectReverse {
+		err = checkReverse(cfg.Forwards, address(pld))
+	} else {
+		checked, err = checkACL(cfg.ACL, dg.device, address(pld), upstream == ruleActionDirect)
+	}
+
+	if err != nil {
+		sendConnectResult(ses, errorToConnectResult(err))
+		return fmt.Errorf("%v: %v", address(pld), err)
+	}
+
 	timeout := 10 * time.Second
-	conn, err := net.DialTimeout("tcp", addr, timeout)
+	conn, err := dialTarget(cfg.Upstream, upstream, address(pld), checked, timeout)
 
 	if err != nil {
+		sendConnectResult(ses, errorToConnectResult(err))
 		return err
 	}
 
 	ses.setPeer(conn)
+	sendConnectResult(ses, connectResultSucceeded)
 
 	go acceptSocks(cfg, ses, stageForward)
 
 	return nil
 }
 
+func sendConnectResult(ses *session, result byte) {
+	pld := payloadConnectResult{
+		result: result,
+	}
+	dg := newDatagram(ses.tunnel.device, 0, 0, commandConnectResult, pld.encode())
+
+	if err := ses.sendDatagram(dg); err != nil {
+		ses.logger().Error("handler: send", "cmd", commandConnectResult, "err", err)
+	}
+}
+
+func errorToConnectResult(err error) byte {
+	var dnsErr *net.DNSError
+	var netErr net.Error
+	var replyErr upstreamReplyError
+
+	switch {
+	case errors.As(err, &replyErr):
+		return replyErr.result
+	case errors.Is(err, errACLDenied), errors.Is(err, errReverseDenied):
+		return connectResultNotAllowed
+	case errors.Is(err, syscall.ECONNREFUSED):
+		return connectResultRefused
+	case errors.Is(err, syscall.ENETUNREACH):
+		return connectResultNetworkUnreachable
+	case errors.Is(err, syscall.EHOSTUNREACH):
+		return connectResultHostUnreachable
+	case errors.As(err, &dnsErr):
+		return connectResultHostUnreachable
+	case errors.As(err, &netErr) && netErr.Timeout():
+		return connectResultTTLExpired
+	default:
+		return connectResultFailure
+	}
+}
+
+func handleConnectResult(ses *session, dg datagram) error {
+	pld := payloadConnectResult{}
+
+	if err := pld.decode(dg.payload); err != nil {
+		return err
+	}
+
+	ses.logger().Debug("handler: connect result", "result", pld.result)
+
+	return ses.setConnectResult(pld)
+}
+
+func handleResolve(ses *session, dg datagram) error {
+	decrypted, err := ses.tunnel.loadKeys().open(dg.key, dg.payload)
+
+	if err != nil {
+		return err
+	}
+
+	pld := payloadResolve{}
+
+	if err := pld.decode(decrypted); err != nil {
+		return err
+	}
+
+	res := resolveName(pld.name, pld.qtype)
+	key, encrypted, err := ses.tunnel.loadKeys().seal(res.encode())
+
+	if err != nil {
+		return err
+	}
+
+	ses.logger().Debug("handler: resolve", "qtype", pld.qtype, "rcode", res.rcode, "ips", len(res.ips))
+
+	resDg := newDatagram(ses.tunnel.device, 0, 0, commandResolveResult, encrypted)
+	resDg.key = key
+
+	return ses.sendDatagram(resDg)
+}
+
+func handleResolveResult(ses *session, dg datagram) error {
+	decrypted, err := ses.tunnel.loadKeys().open(dg.key, dg.payload)
+
+	if err != nil {
+		return err
+	}
+
+	pld := payloadResolveResult{}
+
+	if err := pld.decode(decrypted); err != nil {
+		return err
+	}
+
+	return ses.setResolveResult(pld)
+}
+
 func handleForward(ses *session, dg datagram) error {
 	if err := ses.writePeer(dg.payload); err != nil {
 		return err
@@ -386,6 +523,8 @@ func handleRetry(ses *session, dg datagram) error {
 		return err
 	}
 
+	metricRetries.inc(ses.tunnel.name, "received")
+
 	dg, exists := ses.getHistory(pld.number)
 
 	if exists {
@@ -393,14 +532,15 @@ func handleRetry(ses *session, dg datagram) error {
 			return err
 		}
 	} else {
-		slog.Debug("handler: history miss", "ses", ses, "number", pld.number)
+		ses.logger().Debug("handler: history miss", "number", pld.number)
 	}
 
 	return nil
 }
 
+var handlerRetryInterval = 10 * time.Second
+
 type handlerPriorityQueue struct {
-	cfg     config
 	ses     *session
 	mu      sync.Mutex
 	closed  bool
@@ -412,11 +552,10 @@ type handlerPriorityQueue struct {
 	signal  chan struct{}
 }
 
-func openHandlerPriorityQueue(cfg config, ses *session) *handlerPriorityQueue {
-	slog.Debug("handler: queue open", "ses", ses)
+func openHandlerPriorityQueue(ses *session) *handlerPriorityQueue {
+	ses.logger().Debug("handler: queue open")
 
 	q := &handlerPriorityQueue{
-		cfg:     cfg,
 		ses:     ses,
 		mu:      sync.Mutex{},
 		closed:  false,
@@ -437,7 +576,7 @@ func openHandlerPriorityQueue(cfg config, ses *session) *handlerPriorityQueue {
 }
 
 func (q *handlerPriorityQueue) close() {
-	slog.Debug("handler: queue close", "ses", q.ses)
+	q.ses.logger().Debug("handler: queue close")
 
 	q.mu.Lock()
 	defer q.mu.Unlock()
@@ -478,7 +617,7 @@ func (q *handlerPriorityQueue) add(dg datagram) error {
 }
 
 func (q *handlerPriorityQueue) listen() {
-	retryInterval := 10 * time.Second
+	retryInterval := handlerRetryInterval
 
 	for {
 		stop := false
@@ -518,8 +657,8 @@ func (q *handlerPriorityQueue) handle() bool {
 			break
 		}
 
-		if err := handleCommand(q.cfg, q.ses, dg); err != nil {
-			slog.Error("handler: command", "dg", dg, "err", err)
+		if err := handleCommand(q.ses.cfg(), q.ses, dg); err != nil {
+			q.ses.tunnel.logger().Error("handler: command", "dg", dg, "err", err)
 			return true
 		}
 
@@ -558,15 +697,16 @@ func (q *handlerPriorityQueue) retry() bool {
 		number: q.next,
 	}
 	q.send(commandRetry, pld.encode())
+	metricRetries.inc(q.ses.tunnel.name, "sent")
 
 	return false
 }
 
 func (q *handlerPriorityQueue) send(cmd dgCmd, pld []byte) {
-	dg := newDatagram(0, 0, cmd, pld)
+	dg := newDatagram(q.ses.tunnel.device, 0, 0, cmd, pld)
 
 	if err := q.ses.sendDatagram(dg); err != nil {
-		slog.Error("handler: send", "ses", q.ses, "cmd", cmd, "err", err)
+		q.ses.logger().Error("handler: send", "cmd", cmd, "err", err)
 	}
 }
 
@@ -576,15 +716,25 @@ func clearHandler(ctx context.Context) error {
 		case <-ctx.Done():
 			return nil
 		case <-time.After(5 * time.Minute):
-			handleDatagramMu.Lock()
-
-			for key, queue := range handleDatagramQueues {
-				if queue.isClosed() {
-					delete(handleDatagramQueues, key)
-				}
+			for _, t := range tunnels {
+				t.deleteClosedQueues()
 			}
+		}
+	}
+}
+
+func (t *tunnel) deleteClosedQueues() int {
+	t.queuesMu.Lock()
+	defer t.queuesMu.Unlock()
 
-			handleDatagramMu.Unlock()
+	n := 0
+
+	for key, queue := range t.queues {
+		if queue.isClosed() {
+			delete(t.queues, key)
+			n++
 		}
 	}
+
+	return n
 }
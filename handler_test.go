@@ -0,0 +1,245 @@
+package main
+
+import (
+	"bytes"
+	"log/slog"
+	"math"
+	"net"
+	"slices"
+	"sync"
+	"testing"
+	"time"
+)
+
+// Session without listeners, so test reads its writes and datagrams.
+func newTestSession(t *testing.T, id dgSes) *session {
+	tun := newTunnel("")
+	tun.storeConfig(defaultConfig())
+
+	peer, other := net.Pipe()
+	t.Cleanup(func() {
+		other.Close()
+	})
+
+	now := time.Now()
+
+	return &session{
+		id:        id,
+		tunnel:    tun,
+		log:       slog.Default(),
+		logAttrs:  []any{"ses", id},
+		peer:      peer,
+		onClose:   make(chan struct{}),
+		history:   map[dgNum]datagram{},
+		writes:    make(chan []byte, 500),
+		datagrams: make(chan datagram, 500),
+		connected: make(chan payloadConnectResult, 1),
+		resolved:  make(chan payloadResolveResult, 1),
+		openedAt:  now,
+		activity:  now,
+		posts:     map[configClub]wallPostResponse{},
+		topics:    map[configClub]boardAddTopicResponse{},
+	}
+}
+
+func testForwards(n int) []datagram {
+	datagrams := []datagram{}
+
+	for i := 1; i <= n; i++ {
+		datagrams = append(datagrams, newDatagram(0, 1, dgNum(i), commandForward, []byte{byte(i)}))
+	}
+
+	return datagrams
+}
+
+func testPayload(n int) []byte {
+	b := []byte{}
+
+	for i := 1; i <= n; i++ {
+		b = append(b, byte(i))
+	}
+
+	return b
+}
+
+func readWrites(t *testing.T, ses *session, n int) []byte {
+	b := []byte{}
+
+	for range n {
+		select {
+		case w := <-ses.writes:
+			b = append(b, w...)
+		case <-time.After(5 * time.Second):
+			t.Fatalf("got %v writes, want %v", len(b), n)
+		}
+	}
+
+	return b
+}
+
+func readDatagram(t *testing.T, ses *session) datagram {
+	select {
+	case dg := <-ses.datagrams:
+		return dg
+	case <-time.After(5 * time.Second):
+		t.Fatal("no datagram is sent")
+	}
+
+	return datagram{}
+}
+
+func setRetryInterval(t *testing.T, d time.Duration) {
+	prev := handlerRetryInterval
+	handlerRetryInterval = d
+
+	t.Cleanup(func() {
+		handlerRetryInterval = prev
+	})
+}
+
+func TestHandlerQueueDuplicate(t *testing.T) {
+	ses := newTestSession(t, 1)
+	q := openHandlerPriorityQueue(ses)
+	defer ses.close()
+
+	for _, dg := range testForwards(10) {
+		runWithFault(configFault{Duplicate: 1}, dg, func() {
+			if err := q.add(dg); err != nil {
+				t.Fatal(err)
+			}
+		})
+	}
+
+	if got, want := readWrites(t, ses, 10), testPayload(10); !bytes.Equal(got, want) {
+		t.Fatalf("got %v, want %v", got, want)
+	}
+
+	time.Sleep(100 * time.Millisecond)
+
+	if len(ses.writes) > 0 {
+		t.Fatalf("duplicates are written: %v", len(ses.writes))
+	}
+}
+
+func TestHandlerQueueReorder(t *testing.T) {
+	ses := newTestSession(t, 1)
+	q := openHandlerPriorityQueue(ses)
+	defer ses.close()
+
+	wg := sync.WaitGroup{}
+
+	for _, dg := range testForwards(50) {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+
+			runWithFault(configFault{Reorder: 1, ReorderTimeMS: 100}, dg, func() {
+				q.add(dg)
+			})
+		}()
+	}
+
+	wg.Wait()
+
+	if got, want := readWrites(t, ses, 50), testPayload(50); !bytes.Equal(got, want) {
+		t.Fatalf("got %v, want %v", got, want)
+	}
+}
+
+func TestHandlerQueueRetry(t *testing.T) {
+	setRetryInterval(t, 100*time.Millisecond)
+
+	ses := newTestSession(t, 1)
+	interlocutor := newTestSession(t, -1)
+	q := openHandlerPriorityQueue(ses)
+	defer ses.close()
+
+	sent := metricRetries.value("", "sent")
+	received := metricRetries.value("", "received")
+
+	for _, dg := range testForwards(5) {
+		interlocutor.history[dg.number] = dg
+		fault := configFault{}
+
+		if dg.number == 2 {
+			fault.Drop = 1
+		}
+
+		runWithFault(fault, dg, func() {
+			q.add(dg)
+		})
+	}
+
+	if got := readWrites(t, ses, 1); !bytes.Equal(got, []byte{1}) {
+		t.Fatalf("got %v, want [1]", got)
+	}
+
+	retry := readDatagram(t, ses)
+	pld := payloadRetry{}
+
+	if err := pld.decode(retry.payload); err != nil {
+		t.Fatal(err)
+	}
+
+	if retry.command != commandRetry || pld.number != 2 {
+		t.Fatalf("got command %v for %v, want retry for 2", retry.command, pld.number)
+	}
+
+	if err := handleRetry(interlocutor, retry); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := q.add(readDatagram(t, interlocutor)); err != nil {
+		t.Fatal(err)
+	}
+
+	if got, want := readWrites(t, ses, 4), testPayload(5)[1:]; !bytes.Equal(got, want) {
+		t.Fatalf("got %v, want %v", got, want)
+	}
+
+	if metricRetries.value("", "sent") <= sent || metricRetries.value("", "received") <= received {
+		t.Fatal("retries aren't counted")
+	}
+}
+
+func TestHandlerQueueRetryLimit(t *testing.T) {
+	setRetryInterval(t, 10*time.Millisecond)
+
+	ses := newTestSession(t, 1)
+	q := openHandlerPriorityQueue(ses)
+
+	for _, dg := range testForwards(3) {
+		runWithFault(configFault{Drop: 1}, dg, func() {
+			q.add(dg)
+		})
+	}
+
+	select {
+	case <-ses.onClose:
+	case <-time.After(5 * time.Second):
+		t.Fatal("session isn't closed")
+	}
+
+	commands := []dgCmd{}
+
+	for dg := range ses.datagrams {
+		commands = append(commands, dg.command)
+	}
+
+	want := []dgCmd{commandRetry, commandRetry, commandRetry, commandClose}
+
+	if !slices.Equal(commands, want) {
+		t.Fatalf("got %v, want %v", commands, want)
+	}
+}
+
+func TestNextSessionIDWrap(t *testing.T) {
+	tun := newTunnel("")
+	tun.sessionID = math.MaxInt32 - 1
+	tun.setSession(math.MaxInt32, &session{})
+	tun.setSession(1, &session{})
+
+	if id := tun.nextSessionID(); id != 2 {
+		t.Fatalf("got %v, want 2", id)
+	}
+}
@@ -0,0 +1,136 @@
+package main
+
+import (
+	"errors"
+	"sync"
+	"time"
+)
+
+type health struct {
+	Requests      int       `json:"requests"`
+	Errors        int       `json:"errors"`
+	FloodControl  int       `json:"floodControl"`
+	LastError     string    `json:"lastError,omitempty"`
+	LastErrorAt   time.Time `json:"lastErrorAt,omitzero"`
+	LastSuccessAt time.Time `json:"lastSuccessAt,omitzero"`
+}
+
+func (h *health) record(err error) {
+	h.Requests++
+
+	if err == nil {
+		h.LastSuccessAt = time.Now()
+		return
+	}
+
+	h.Errors++
+	h.LastError = err.Error()
+	h.LastErrorAt = time.Now()
+
+	if errors.Is(err, errFloodControl) {
+		h.FloodControl++
+	}
+}
+
+// Names are unique only within a tunnel.
+type healthKey struct {
+	tunnel string
+	name   string
+}
+
+var clubsHealth = map[healthKey]*health{}
+var usersHealth = map[healthKey]*health{}
+var methodsHealth = map[int]*health{}
+var clubsDisabled = map[healthKey]bool{}
+var usersDisabled = map[healthKey]bool{}
+var healthMu = sync.Mutex{}
+
+func clubHealthKey(club configClub) healthKey {
+	return healthKey{club.Tunnel, club.Name}
+}
+
+func userHealthKey(user configUser) healthKey {
+	return healthKey{user.Tunnel, user.Name}
+}
+
+func getHealth(m map[healthKey]*health, key healthKey) *health {
+	h, exists := m[key]
+
+	if !exists {
+		h = &health{}
+		m[key] = h
+	}
+
+	return h
+}
+
+func recordAPIHealth(club configClub, user configUser, err error) {
+	healthMu.Lock()
+	defer healthMu.Unlock()
+
+	if len(club.Name) > 0 {
+		getHealth(clubsHealth, clubHealthKey(club)).record(err)
+	}
+
+	if len(user.Name) > 0 {
+		getHealth(usersHealth, userHealthKey(user)).record(err)
+	}
+}
+
+func recordMethodHealth(method int, err error) {
+	healthMu.Lock()
+	defer healthMu.Unlock()
+
+	h, exists := methodsHealth[method]
+
+	if !exists {
+		h = &health{}
+		methodsHealth[method] = h
+	}
+
+	h.record(err)
+}
+
+func setClubDisabled(key healthKey, disabled bool) {
+	healthMu.Lock()
+	defer healthMu.Unlock()
+
+	clubsDisabled[key] = disabled
+}
+
+func setUserDisabled(key healthKey, disabled bool) {
+	healthMu.Lock()
+	defer healthMu.Unlock()
+
+	usersDisabled[key] = disabled
+}
+
+func enabledClubs(clubs []configClub) []configClub {
+	healthMu.Lock()
+	defer healthMu.Unlock()
+
+	enabled := []configClub{}
+
+	for _, club := range clubs {
+		if !clubsDisabled[clubHealthKey(club)] {
+			enabled = append(enabled, club)
+		}
+	}
+
+	return enabled
+}
+
+func enabledUsers(users []configUser) []configUser {
+	healthMu.Lock()
+	defer healthMu.Unlock()
+
+	enabled := []configUser{}
+
+	for _, user := range users {
+		if !usersDisabled[userHealthKey(user)] {
+			enabled = append(enabled, user)
+		}
+	}
+
+	return enabled
+}
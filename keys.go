@@ -0,0 +1,177 @@
+package main
+
+import (
+	"errors"
+	"maps"
+	"sort"
+	"time"
+)
+
+// Payloads encrypted with session.secret have key ID 0 in datagram header.
+const keyIDLegacy dgKey = 0
+
+var (
+	errKeyNotFound = errors.New("key not found")
+	errKeyRejected = errors.New("no accepted key can decrypt payload")
+)
+
+type keyRing struct {
+	active     dgKey
+	configured dgKey
+	keys       map[dgKey][]byte
+	inactive   map[dgKey]time.Time
+	grace      time.Duration
+}
+
+func (t *tunnel) loadKeys() *keyRing {
+	return t.keys.Load()
+}
+
+// Key promoted with admin API stays active on reload
+// as long as session.activeKey in config isn't changed.
+// Grace period starts only when key is retired, so keys added
+// in advance are accepted until they are removed from config.
+func (t *tunnel) storeKeys(cfg configSession) {
+	t.keysMu.Lock()
+	defer t.keysMu.Unlock()
+
+	prev := t.keys.Load()
+	r := &keyRing{
+		active:     dgKey(cfg.ActiveKey),
+		configured: dgKey(cfg.ActiveKey),
+		keys:       map[dgKey][]byte{},
+		inactive:   map[dgKey]time.Time{},
+		grace:      cfg.Grace(),
+	}
+
+	if len(cfg.SecretKey) > 0 {
+		r.keys[keyIDLegacy] = cfg.SecretKey
+	}
+
+	for _, key := range cfg.Keys {
+		r.keys[dgKey(key.ID)] = key.Key
+	}
+
+	if prev == nil {
+		t.keys.Store(r)
+		return
+	}
+
+	if _, exists := r.keys[prev.active]; exists && prev.configured == r.configured {
+		r.active = prev.active
+	}
+
+	if prev.active != r.active {
+		t.logger().Info("keys: active", "key", r.active, "previous", prev.active)
+	}
+
+	if prev.active != prev.configured && prev.active != r.active {
+		t.logger().Warn("keys: promoted key is discarded", "key", prev.active)
+	}
+
+	now := time.Now()
+
+	for id := range r.keys {
+		if id == r.active {
+			continue
+		}
+
+		if id == prev.active {
+			r.inactive[id] = now
+		} else if since, exists := prev.inactive[id]; exists {
+			r.inactive[id] = since
+		}
+	}
+
+	t.keys.Store(r)
+}
+
+func (t *tunnel) promoteKey(id dgKey) error {
+	t.keysMu.Lock()
+	defer t.keysMu.Unlock()
+
+	prev := t.keys.Load()
+
+	if _, exists := prev.keys[id]; !exists {
+		return errKeyNotFound
+	}
+
+	if prev.active == id {
+		return nil
+	}
+
+	r := &keyRing{
+		active:     id,
+		configured: prev.configured,
+		keys:       prev.keys,
+		inactive:   maps.Clone(prev.inactive),
+		grace:      prev.grace,
+	}
+
+	r.inactive[prev.active] = time.Now()
+	delete(r.inactive, id)
+	t.keys.Store(r)
+
+	t.logger().Warn("keys: promotion isn't saved, set session.activeKey to keep it after restart", "key", id)
+
+	return nil
+}
+
+// Retired keys are accepted only during grace period.
+func (r *keyRing) isAccepted(id dgKey) bool {
+	if _, exists := r.keys[id]; !exists {
+		return false
+	}
+
+	since, inactive := r.inactive[id]
+
+	return !inactive || time.Since(since) < r.grace
+}
+
+func (r *keyRing) graceLeft(id dgKey) time.Duration {
+	since, inactive := r.inactive[id]
+
+	if !inactive {
+		return 0
+	}
+
+	return max(r.grace-time.Since(since), 0)
+}
+
+func (r *keyRing) ids() []dgKey {
+	ids := []dgKey{}
+
+	for id := range r.keys {
+		ids = append(ids, id)
+	}
+
+	sort.Slice(ids, func(i, j int) bool {
+		return ids[i] < ids[j]
+	})
+
+	return ids
+}
+
+func (r *keyRing) seal(data []byte) (dgKey, []byte, error) {
+	encrypted, err := encrypt(data, r.keys[r.active])
+
+	if err != nil {
+		return 0, nil, err
+	}
+
+	return r.active, encrypted, nil
+}
+
+func (r *keyRing) open(id dgKey, data []byte) ([]byte, error) {
+	if !r.isAccepted(id) {
+		return nil, errKeyRejected
+	}
+
+	decrypted, err := decrypt(data, r.keys[id])
+
+	if err != nil {
+		return nil, errKeyRejected
+	}
+
+	return decrypted, nil
+}
@@ -0,0 +1,98 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"testing"
+)
+
+func testSessionKey(t *testing.T, id int) configSessionKey {
+	secret, err := generateSecret()
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	key, err := secretToKey(secret)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return configSessionKey{ID: id, Secret: secret, Key: key}
+}
+
+func TestKeyRingHeader(t *testing.T) {
+	tun := newTunnel("")
+	legacy := testSessionKey(t, 0)
+	cfg := configSession{
+		SecretKey: legacy.Key,
+		Keys:      []configSessionKey{testSessionKey(t, 1)},
+		ActiveKey: 1,
+		GraceMS:   60000,
+	}
+	tun.storeKeys(cfg)
+
+	key, encrypted, err := tun.loadKeys().seal([]byte("payload"))
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	dg := newDatagram(tun.device, 1, 1, commandConnect, encrypted)
+	dg.key = key
+	decoded, err := decodeDatagram(encodeDatagram(dg, datagramEncodingASCII))
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if decoded.key != 1 || decoded.version != datagramVersion {
+		t.Fatalf("got key %v version %v, want 1 and %v", decoded.key, decoded.version, datagramVersion)
+	}
+
+	decrypted, err := tun.loadKeys().open(decoded.key, decoded.payload)
+
+	if err != nil || !bytes.Equal(decrypted, []byte("payload")) {
+		t.Fatalf("got %q, %v", decrypted, err)
+	}
+
+	if _, err := tun.loadKeys().open(keyIDLegacy, decoded.payload); !errors.Is(err, errKeyRejected) {
+		t.Fatalf("got %v, want %v", err, errKeyRejected)
+	}
+}
+
+func TestKeyRingGrace(t *testing.T) {
+	tun := newTunnel("")
+	cfg := configSession{
+		SecretKey: testSessionKey(t, 0).Key,
+		Keys:      []configSessionKey{testSessionKey(t, 1)},
+		ActiveKey: 0,
+		GraceMS:   0,
+	}
+	tun.storeKeys(cfg)
+	tun.storeKeys(cfg)
+
+	if !tun.loadKeys().isAccepted(1) {
+		t.Fatal("key added in advance isn't accepted")
+	}
+
+	if err := tun.promoteKey(1); err != nil {
+		t.Fatal(err)
+	}
+
+	tun.storeKeys(cfg)
+	ring := tun.loadKeys()
+
+	if ring.active != 1 || ring.isAccepted(0) {
+		t.Fatalf("got active %v, accepted retired %v", ring.active, ring.isAccepted(0))
+	}
+
+	cfg.ActiveKey = 1
+	tun.storeKeys(cfg)
+	ring = tun.loadKeys()
+
+	if ring.active != 1 || ring.isAccepted(0) {
+		t.Fatalf("got active %v, accepted retired %v", ring.active, ring.isAccepted(0))
+	}
+}
@@ -0,0 +1,130 @@
+package main
+
+import (
+	"context"
+	"io"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+const (
+	logFormatText = "text"
+	logFormatJSON = "json"
+)
+
+func openLogOutput(name string, rotate configLogRotate) (io.Writer, error) {
+	if len(name) == 0 {
+		return os.Stderr, nil
+	}
+
+	if rotate.isEnabled() {
+		return openRotateWriter(name, rotate)
+	}
+
+	return os.OpenFile(name, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+}
+
+var logLevel = new(slog.LevelVar)
+var logBridge = false
+
+func setLogLevel(level int) {
+	logLevel.Set(slog.Level(level))
+
+	if logBridge {
+		slog.SetLogLoggerLevel(slog.Level(level))
+	}
+}
+
+func newLogHandler(w io.Writer, format string) slog.Handler {
+	opts := &slog.HandlerOptions{
+		Level: logLevel,
+	}
+
+	if format == logFormatJSON {
+		return slog.NewJSONHandler(w, opts)
+	}
+
+	return slog.NewTextHandler(w, opts)
+}
+
+type payloadLogger struct {
+	logger  *slog.Logger
+	rate    int
+	mu      sync.Mutex
+	window  time.Time
+	count   int
+	dropped int
+}
+
+var payloadLog *payloadLogger
+
+// Payload written to the main log file goes through the main writer,
+// otherwise two writers would rotate the same file independently.
+func configurePayloadLogger(cfg configLog, output io.Writer) error {
+	if !cfg.Payload {
+		payloadLog = nil
+		return nil
+	}
+
+	w := output
+
+	if len(cfg.PayloadOutput) > 0 && filepath.Clean(cfg.PayloadOutput) != filepath.Clean(cfg.Output) {
+		var err error
+
+		if w, err = openLogOutput(cfg.PayloadOutput, cfg.Rotate); err != nil {
+			return err
+		}
+	}
+
+	payloadLog = &payloadLogger{
+		logger: slog.New(newLogHandler(w, cfg.Format)),
+		rate:   cfg.PayloadRate,
+	}
+
+	return nil
+}
+
+func (p *payloadLogger) allow() (bool, int) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	now := time.Now()
+	dropped := 0
+
+	if now.Sub(p.window) >= time.Second {
+		dropped = p.dropped
+		p.window = now
+		p.count = 0
+		p.dropped = 0
+	}
+
+	if p.count >= p.rate {
+		p.dropped++
+		return false, dropped
+	}
+
+	p.count++
+
+	return true, dropped
+}
+
+func logPayload(msg string, ses *session, direction string, b []byte) {
+	p := payloadLog
+
+	if p == nil || !p.logger.Enabled(context.Background(), slog.LevelDebug) {
+		return
+	}
+
+	allowed, dropped := p.allow()
+
+	if dropped > 0 {
+		p.logger.Warn("payload: dropped", "count", dropped)
+	}
+
+	if allowed {
+		p.logger.With(ses.loggerAttrs()...).Debug(msg, direction, bytesToHex(b))
+	}
+}
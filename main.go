@@ -25,7 +25,7 @@ func main() {
 
 	if err := run(ctx, errs); err != nil {
 		fmt.Fprintln(os.Stderr, err)
-		code = 1
+		code = exitCode(err)
 	}
 
 	if runtime.GOOS == "windows" {
@@ -40,10 +40,22 @@ func run(ctx context.Context, errs chan<- error) error {
 	var cfgPath string
 	var printVersion bool
 	var genSecret bool
+	var showStatus bool
+	var replayTracePath string
+	var checkOnly bool
+	var setup bool
+	var exportPairingPath string
+	var importPairingSource string
 
 	flag.StringVar(&cfgPath, "config", "config.json", "path to configuration file")
 	flag.BoolVar(&printVersion, "version", false, "print version")
 	flag.BoolVar(&genSecret, "secret", false, "generate secret")
+	flag.BoolVar(&showStatus, "status", false, "show status of running instance")
+	flag.BoolVar(&checkOnly, "check-config", false, "check configuration and exit")
+	flag.BoolVar(&setup, "setup", false, "provision clubs and write configuration")
+	flag.StringVar(&exportPairingPath, "export-pairing", "", "export secret and clubs as pairing blob and QR code image")
+	flag.StringVar(&importPairingSource, "import-pairing", "", "merge pairing blob, file or QR code image into configuration")
+	flag.StringVar(&replayTracePath, "replay-trace", "", "print per-session timelines from trace file")
 
 	flag.Parse()
 
@@ -65,79 +77,114 @@ func run(ctx context.Context, errs chan<- error) error {
 		return nil
 	}
 
+	if len(replayTracePath) > 0 {
+		if err := replayTrace(replayTracePath, os.Stdout); err != nil {
+			return fmt.Errorf("replay trace: %v", err)
+		}
+
+		return nil
+	}
+
+	if setup {
+		return runSetup(cfgPath, os.Stdin, os.Stdout)
+	}
+
+	if len(exportPairingPath) > 0 {
+		return runExportPairing(cfgPath, exportPairingPath, os.Stdin, os.Stdout)
+	}
+
+	if len(importPairingSource) > 0 {
+		return runImportPairing(cfgPath, importPairingSource, os.Stdin, os.Stdout)
+	}
+
+	if checkOnly {
+		return runCheckConfig(cfgPath, os.Stdout)
+	}
+
 	cfg, err := parseConfig(cfgPath)
 
 	if err != nil {
-		return fmt.Errorf("parse config: %v", err)
+		return exitError{exitCodeConfig, fmt.Errorf("parse config: %v", err)}
+	}
+
+	if showStatus {
+		return runStatus(ctx, cfg)
 	}
 
 	if err := validateConfig(cfg); err != nil {
-		return fmt.Errorf("validate config: %v", err)
+		return exitError{exitCodeConfig, fmt.Errorf("validate config: %v", err)}
 	}
 
 	if err := configureLogger(cfg.Log); err != nil {
 		return fmt.Errorf("configure logger: %v", err)
 	}
 
-	if err := configureDNS(cfg.DNS); err != nil {
-		return fmt.Errorf("configure dns: %v", err)
+	if err := configureTrace(cfg.Trace); err != nil {
+		return fmt.Errorf("configure trace: %v", err)
 	}
 
-	if err := validateQR(cfg.QR); err != nil {
-		return fmt.Errorf("validate qr: %v", err)
+	if err := configureDNS(cfg.DNS); err != nil {
+		return fmt.Errorf("configure dns: %v", err)
 	}
 
-	for _, club := range cfg.Clubs {
-		if err := validateClub(cfg.API, club); err != nil {
-			return fmt.Errorf("validate club: %v: %v", club.Name, err)
+	for _, tc := range cfg.tunnels() {
+		if err := validateTunnel(tc.Config); err != nil {
+			return tunnelError(tc.Name, err)
 		}
 
-		if err := validateLongPoll(cfg.API, club); err != nil {
-			return fmt.Errorf("validate long poll: %v: %v", club.Name, err)
-		}
-	}
+		t := newTunnel(tc.Name)
 
-	for _, user := range cfg.Users {
-		if err := validateUser(cfg.API, user); err != nil {
-			return fmt.Errorf("validate user: %v: %v", user.Name, err)
+		if tc.Config.Session.Device != 0 {
+			t.device = dgDev(tc.Config.Session.Device)
 		}
-	}
 
-	if err := initSession(cfg); err != nil {
-		return fmt.Errorf("init session: %v", err)
+		t.storeConfig(tc.Config)
+		tunnels = append(tunnels, t)
 	}
 
-	var wg sync.WaitGroup
-
-	wg.Add(1)
-	go func() {
-		defer wg.Done()
+	reloadPath = cfgPath
 
-		if err := listenSocks(ctx, cfg); err != nil {
-			errs <- fmt.Errorf("listen socks: %v", err)
-		}
-	}()
+	var wg sync.WaitGroup
 
-	for _, club := range cfg.Clubs {
+	if cfg.Admin.Port != 0 {
 		wg.Add(1)
-		go func(club configClub) {
+		go func() {
 			defer wg.Done()
 
-			if err := listenLongPoll(ctx, cfg, club); err != nil {
-				errs <- fmt.Errorf("listen long poll: %v", err)
+			if err := listenAdmin(ctx, cfg); err != nil {
+				errs <- fmt.Errorf("listen admin: %v", err)
 			}
-		}(club)
+		}()
+	}
 
+	if cfg.Metrics.Port != 0 {
 		wg.Add(1)
-		go func(club configClub) {
+		go func() {
 			defer wg.Done()
 
-			if err := listenStorage(ctx, cfg, club); err != nil {
-				errs <- fmt.Errorf("listen storage: %v", err)
+			if err := listenMetrics(ctx, cfg); err != nil {
+				errs <- fmt.Errorf("listen metrics: %v", err)
 			}
-		}(club)
+		}()
 	}
 
+	for _, t := range tunnels {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			runTunnel(ctx, t, errs)
+		}()
+	}
+
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+
+		if err := listenReload(ctx); err != nil {
+			errs <- fmt.Errorf("listen reload: %v", err)
+		}
+	}()
+
 	wg.Add(1)
 	go func() {
 		defer wg.Done()
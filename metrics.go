@@ -0,0 +1,294 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+type metric interface {
+	write(w io.Writer)
+}
+
+var metricsRegistry = []metric{}
+
+var (
+	metricDatagramsSent     = newMetricCounter("vkproxy_datagrams_sent_total", "Datagrams sent to VK.", "tunnel", "method", "club")
+	metricDatagramsReceived = newMetricCounter("vkproxy_datagrams_received_total", "Datagrams received from VK.", "tunnel", "type", "club")
+	metricAPIRequests       = newMetricHistogram("vkproxy_api_request_duration_seconds", "VK API request duration.", []float64{0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10, 30}, "tunnel", "method", "result")
+	metricAPIErrors         = newMetricCounter("vkproxy_api_errors_total", "VK API errors by code.", "tunnel", "method", "code")
+	metricFloodControl      = newMetricCounter("vkproxy_flood_control_total", "VK API flood control hits.", "tunnel", "method", "club")
+	metricRetries           = newMetricCounter("vkproxy_retries_total", "Retry requests for missing datagrams.", "tunnel", "direction")
+	metricBytes             = newMetricCounter("vkproxy_bytes_total", "Payload bytes in and out.", "tunnel", "direction")
+	metricLongPollReconnect = newMetricCounter("vkproxy_long_poll_reconnects_total", "Long poll reconnects.", "tunnel", "club")
+	metricSessionDuration   = newMetricHistogram("vkproxy_session_duration_seconds", "Session duration.", []float64{1, 5, 15, 60, 300, 900, 3600}, "tunnel", "direct")
+)
+
+func init() {
+	newMetricGauge("vkproxy_sessions_active", "Active sessions.", func() float64 {
+		n := 0
+
+		forEachTunnelSession(func(ses *session) {
+			n++
+		})
+
+		return float64(n)
+	})
+
+	newMetricGauge("vkproxy_session_writes_queued", "Writes queued to peers across sessions.", func() float64 {
+		n := 0
+
+		forEachTunnelSession(func(ses *session) {
+			n += len(ses.writes)
+		})
+
+		return float64(n)
+	})
+
+	newMetricGauge("vkproxy_session_datagrams_queued", "Datagrams queued to VK across sessions.", func() float64 {
+		n := 0
+
+		forEachTunnelSession(func(ses *session) {
+			n += len(ses.datagrams)
+		})
+
+		return float64(n)
+	})
+}
+
+func listenMetrics(ctx context.Context, cfg config) error {
+	addr := address{cfg.Metrics.Host, cfg.Metrics.Port}.String()
+	ln, err := net.Listen("tcp", addr)
+
+	if err != nil {
+		return err
+	}
+
+	mux := http.NewServeMux()
+
+	mux.HandleFunc("GET /metrics", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+		writeMetrics(w)
+	})
+
+	srv := &http.Server{
+		Handler:           mux,
+		ReadHeaderTimeout: 10 * time.Second,
+	}
+
+	go func() {
+		<-ctx.Done()
+		srv.Close()
+	}()
+
+	slog.Info("metrics: listening", "addr", addr)
+
+	if err := srv.Serve(ln); err != nil && !errors.Is(err, http.ErrServerClosed) {
+		return err
+	}
+
+	return nil
+}
+
+func writeMetrics(w io.Writer) {
+	for _, m := range metricsRegistry {
+		m.write(w)
+	}
+}
+
+type metricCounter struct {
+	name   string
+	help   string
+	labels []string
+	mu     sync.Mutex
+	values map[string]float64
+}
+
+func newMetricCounter(name string, help string, labels ...string) *metricCounter {
+	m := &metricCounter{
+		name:   name,
+		help:   help,
+		labels: labels,
+		values: map[string]float64{},
+	}
+	metricsRegistry = append(metricsRegistry, m)
+
+	return m
+}
+
+func (m *metricCounter) inc(values ...string) {
+	m.add(1, values...)
+}
+
+func (m *metricCounter) add(v float64, values ...string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.values[metricLabels(m.labels, values)] += v
+}
+
+func (m *metricCounter) value(values ...string) float64 {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	return m.values[metricLabels(m.labels, values)]
+}
+
+func (m *metricCounter) write(w io.Writer) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	fmt.Fprintf(w, "# HELP %v %v\n# TYPE %v counter\n", m.name, m.help, m.name)
+
+	for _, key := range sortedKeys(m.values) {
+		fmt.Fprintf(w, "%v%v %v\n", m.name, key, formatMetric(m.values[key]))
+	}
+}
+
+type metricGauge struct {
+	name  string
+	help  string
+	value func() float64
+}
+
+func newMetricGauge(name string, help string, value func() float64) *metricGauge {
+	m := &metricGauge{
+		name:  name,
+		help:  help,
+		value: value,
+	}
+	metricsRegistry = append(metricsRegistry, m)
+
+	return m
+}
+
+func (m *metricGauge) write(w io.Writer) {
+	fmt.Fprintf(w, "# HELP %v %v\n# TYPE %v gauge\n", m.name, m.help, m.name)
+	fmt.Fprintf(w, "%v %v\n", m.name, formatMetric(m.value()))
+}
+
+type metricHistogram struct {
+	name    string
+	help    string
+	labels  []string
+	buckets []float64
+	mu      sync.Mutex
+	values  map[string]*histogramValue
+}
+
+type histogramValue struct {
+	counts []uint64
+	sum    float64
+	count  uint64
+}
+
+func newMetricHistogram(name string, help string, buckets []float64, labels ...string) *metricHistogram {
+	m := &metricHistogram{
+		name:    name,
+		help:    help,
+		labels:  labels,
+		buckets: buckets,
+		values:  map[string]*histogramValue{},
+	}
+	metricsRegistry = append(metricsRegistry, m)
+
+	return m
+}
+
+func (m *metricHistogram) observe(v float64, values ...string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	key := metricLabels(m.labels, values)
+	hv, exists := m.values[key]
+
+	if !exists {
+		hv = &histogramValue{
+			counts: make([]uint64, len(m.buckets)),
+		}
+		m.values[key] = hv
+	}
+
+	for i, le := range m.buckets {
+		if v <= le {
+			hv.counts[i]++
+		}
+	}
+
+	hv.sum += v
+	hv.count++
+}
+
+func (m *metricHistogram) write(w io.Writer) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	fmt.Fprintf(w, "# HELP %v %v\n# TYPE %v histogram\n", m.name, m.help, m.name)
+
+	for _, key := range sortedKeys(m.values) {
+		hv := m.values[key]
+		prefix := strings.TrimSuffix(key, "}")
+
+		if len(prefix) == 0 {
+			prefix = "{"
+		} else {
+			prefix += ","
+		}
+
+		for i, le := range m.buckets {
+			fmt.Fprintf(w, "%v_bucket%vle=\"%v\"} %v\n", m.name, prefix, formatMetric(le), hv.counts[i])
+		}
+
+		fmt.Fprintf(w, "%v_bucket%vle=\"+Inf\"} %v\n", m.name, prefix, hv.count)
+		fmt.Fprintf(w, "%v_sum%v %v\n", m.name, key, formatMetric(hv.sum))
+		fmt.Fprintf(w, "%v_count%v %v\n", m.name, key, hv.count)
+	}
+}
+
+func metricLabels(names []string, values []string) string {
+	if len(names) == 0 {
+		return ""
+	}
+
+	pairs := make([]string, len(names))
+
+	for i, name := range names {
+		value := ""
+
+		if i < len(values) {
+			value = values[i]
+		}
+
+		pairs[i] = fmt.Sprintf("%v=\"%v\"", name, metricLabelEscaper.Replace(value))
+	}
+
+	return "{" + strings.Join(pairs, ",") + "}"
+}
+
+// Exposition format escapes only these, unlike Go quoting.
+var metricLabelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+func formatMetric(v float64) string {
+	return strconv.FormatFloat(v, 'g', -1, 64)
+}
+
+func sortedKeys[T any](m map[string]T) []string {
+	keys := make([]string, 0, len(m))
+
+	for key := range m {
+		keys = append(keys, key)
+	}
+
+	sort.Strings(keys)
+
+	return keys
+}
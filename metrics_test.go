@@ -0,0 +1,21 @@
+package main
+
+import "testing"
+
+func TestMetricLabels(t *testing.T) {
+	tests := []struct {
+		values []string
+		want   string
+	}{
+		{[]string{"a", "club"}, `{tunnel="a",club="club"}`},
+		{[]string{"", "клуб"}, `{tunnel="",club="клуб"}`},
+		{[]string{"a\\b", "say \"hi\"\n"}, `{tunnel="a\\b",club="say \"hi\"\n"}`},
+		{[]string{"a"}, `{tunnel="a",club=""}`},
+	}
+
+	for _, tt := range tests {
+		if got := metricLabels([]string{"tunnel", "club"}, tt.values); got != tt.want {
+			t.Fatalf("%q: got %v, want %v", tt.values, got, tt.want)
+		}
+	}
+}
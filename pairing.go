@@ -0,0 +1,331 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"compress/flate"
+	"crypto/pbkdf2"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+)
+
+const (
+	pairingPrefix     = "vkp1:"
+	pairingSaltSize   = 16
+	pairingIterations = 600000
+)
+
+type pairing struct {
+	Secret    string             `json:"secret"`
+	Keys      []configSessionKey `json:"keys,omitempty"`
+	ActiveKey int                `json:"activeKey,omitempty"`
+	Clubs     []configClub       `json:"clubs"`
+}
+
+func pairingKey(passphrase string, salt []byte) ([]byte, error) {
+	return pbkdf2.Key(sha256.New, passphrase, salt, pairingIterations, 32)
+}
+
+// Blob is prefix followed by base64 of salt and encrypted
+// deflated JSON, so it fits into a single QR code.
+func encodePairing(p pairing, passphrase string) (string, error) {
+	data, err := json.Marshal(p)
+
+	if err != nil {
+		return "", err
+	}
+
+	buf := bytes.Buffer{}
+	w, err := flate.NewWriter(&buf, flate.BestCompression)
+
+	if err != nil {
+		return "", err
+	}
+
+	if _, err := w.Write(data); err != nil {
+		return "", err
+	}
+
+	if err := w.Close(); err != nil {
+		return "", err
+	}
+
+	salt := make([]byte, pairingSaltSize)
+
+	if _, err := rand.Read(salt); err != nil {
+		return "", err
+	}
+
+	key, err := pairingKey(passphrase, salt)
+
+	if err != nil {
+		return "", err
+	}
+
+	encrypted, err := encrypt(buf.Bytes(), key)
+
+	if err != nil {
+		return "", err
+	}
+
+	blob := append(salt, encrypted...)
+
+	return pairingPrefix + base64.RawURLEncoding.EncodeToString(blob), nil
+}
+
+func decodePairing(s string, passphrase string) (pairing, error) {
+	s, found := strings.CutPrefix(strings.TrimSpace(s), pairingPrefix)
+
+	if !found {
+		return pairing{}, errors.New("not a pairing blob")
+	}
+
+	blob, err := base64.RawURLEncoding.DecodeString(s)
+
+	if err != nil {
+		return pairing{}, err
+	}
+
+	if len(blob) < pairingSaltSize {
+		return pairing{}, errors.New("malformed")
+	}
+
+	key, err := pairingKey(passphrase, blob[:pairingSaltSize])
+
+	if err != nil {
+		return pairing{}, err
+	}
+
+	compressed, err := decrypt(blob[pairingSaltSize:], key)
+
+	if err != nil {
+		return pairing{}, errors.New("wrong passphrase or corrupted blob")
+	}
+
+	data, err := io.ReadAll(flate.NewReader(bytes.NewReader(compressed)))
+
+	if err != nil {
+		return pairing{}, err
+	}
+
+	p := pairing{}
+
+	if err := json.Unmarshal(data, &p); err != nil {
+		return pairing{}, err
+	}
+
+	return p, nil
+}
+
+// Blob can be attacked offline, so generated passphrase has 128 bits.
+func generatePassphrase() (string, error) {
+	b := make([]byte, 16)
+
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+
+	return hex.EncodeToString(b), nil
+}
+
+func runExportPairing(name string, image string, in io.Reader, out io.Writer) error {
+	cfg, err := parseConfig(name)
+
+	if err != nil {
+		return exitError{exitCodeConfig, fmt.Errorf("parse config: %v", err)}
+	}
+
+	if len(cfg.Tunnels) > 0 {
+		return exitError{exitCodeConfig, errors.New("config uses tunnels, export is supported only for config without them")}
+	}
+
+	if (len(cfg.Session.Secret) == 0 && len(cfg.Session.Keys) == 0) || len(cfg.Clubs) == 0 {
+		return exitError{exitCodeConfig, errors.New("config must have session.secret or session.keys and clubs")}
+	}
+
+	fmt.Fprintln(out, "Warning: the blob contains session secret and club access tokens")
+
+	prompt := setupPrompt{
+		in:  bufio.NewReader(in),
+		out: out,
+	}
+	passphrase, err := prompt.ask("Pairing passphrase, empty to generate", "")
+
+	if err != nil {
+		return err
+	}
+
+	if len(passphrase) == 0 {
+		if passphrase, err = generatePassphrase(); err != nil {
+			return fmt.Errorf("generate passphrase: %v", err)
+		}
+
+		fmt.Fprintf(out, "Generated passphrase: %v\n", passphrase)
+	}
+
+	p := pairing{
+		Secret:    cfg.Session.Secret,
+		Keys:      cfg.Session.Keys,
+		ActiveKey: cfg.Session.ActiveKey,
+		Clubs:     cfg.Clubs,
+	}
+	blob, err := encodePairing(p, passphrase)
+
+	if err != nil {
+		return fmt.Errorf("encode pairing: %v", err)
+	}
+
+	fmt.Fprintln(out, blob)
+
+	qr, err := encodeQR(cfg.QR, blob)
+
+	if err != nil {
+		return fmt.Errorf("encode qr: %v", err)
+	}
+
+	if err := os.WriteFile(image, qr, 0600); err != nil {
+		return err
+	}
+
+	fmt.Fprintf(out, "QR code is written to %v\n", image)
+	fmt.Fprintln(out, "Pass the blob or QR code and the passphrase to the other device separately")
+
+	return nil
+}
+
+func runImportPairing(name string, source string, in io.Reader, out io.Writer) error {
+	cfg, err := loadEditableConfig(name, out)
+
+	if err != nil {
+		return err
+	}
+
+	blob, err := readPairing(cfg.QR, source)
+
+	if err != nil {
+		return fmt.Errorf("read pairing: %v", err)
+	}
+
+	prompt := setupPrompt{
+		in:  bufio.NewReader(in),
+		out: out,
+	}
+	passphrase, err := prompt.askRequired("Pairing passphrase")
+
+	if err != nil {
+		return err
+	}
+
+	p, err := decodePairing(blob, passphrase)
+
+	if err != nil {
+		return fmt.Errorf("decode pairing: %v", err)
+	}
+
+	if err := mergePairing(&cfg, p, out); err != nil {
+		return fmt.Errorf("merge pairing: %v", err)
+	}
+
+	if err := writeConfig(name, cfg); err != nil {
+		return err
+	}
+
+	fmt.Fprintf(out, "Config is written to %v\n", name)
+
+	if len(cfg.Users) == 0 {
+		fmt.Fprintln(out, "Add at least one user to config, then start vk-proxy")
+	}
+
+	return nil
+}
+
+// Source is either the blob itself, a text file with it
+// or an image with QR code.
+func readPairing(cfg configQR, source string) (string, error) {
+	if strings.HasPrefix(source, pairingPrefix) {
+		return source, nil
+	}
+
+	switch strings.ToLower(filepath.Ext(source)) {
+	case ".png", ".jpg", ".jpeg":
+		content, err := decodeQR(cfg, source)
+
+		if err != nil {
+			return "", err
+		}
+
+		return content[0], nil
+	}
+
+	data, err := os.ReadFile(source)
+
+	if err != nil {
+		return "", err
+	}
+
+	return string(data), nil
+}
+
+// Secret and keys are replaced. Clubs with the same ID are updated,
+// other clubs are added.
+func mergePairing(cfg *config, p pairing, out io.Writer) error {
+	if len(p.Secret) > 0 {
+		if _, err := secretToKey(p.Secret); err != nil {
+			return fmt.Errorf("secret: %v", err)
+		}
+	}
+
+	for _, key := range p.Keys {
+		if _, err := secretToKey(key.Secret); err != nil {
+			return fmt.Errorf("key %v: %v", key.ID, err)
+		}
+	}
+
+	if len(cfg.Session.Secret) > 0 && cfg.Session.Secret != p.Secret {
+		fmt.Fprintln(out, "session.secret is replaced")
+	}
+
+	sameKey := func(a configSessionKey, b configSessionKey) bool {
+		return a.ID == b.ID && a.Secret == b.Secret
+	}
+
+	if len(cfg.Session.Keys) > 0 && !slices.EqualFunc(cfg.Session.Keys, p.Keys, sameKey) {
+		fmt.Fprintln(out, "session.keys are replaced")
+	}
+
+	cfg.Session.Secret = p.Secret
+	cfg.Session.Keys = p.Keys
+	cfg.Session.ActiveKey = p.ActiveKey
+
+	for _, club := range p.Clubs {
+		i := -1
+
+		for j := range cfg.Clubs {
+			if cfg.Clubs[j].ID == club.ID {
+				i = j
+			} else if cfg.Clubs[j].Name == club.Name {
+				return fmt.Errorf("club name %v is used by club %v", club.Name, cfg.Clubs[j].ID)
+			}
+		}
+
+		if i >= 0 {
+			cfg.Clubs[i] = club
+			fmt.Fprintf(out, "%v: club is updated\n", club.Name)
+		} else {
+			cfg.Clubs = append(cfg.Clubs, club)
+			fmt.Fprintf(out, "%v: club is added\n", club.Name)
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,55 @@
+package main
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestPairingRoundTrip(t *testing.T) {
+	passphrase, err := generatePassphrase()
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(passphrase) != 32 {
+		t.Fatalf("got passphrase of %v chars, want 32", len(passphrase))
+	}
+
+	want := pairing{
+		Secret:    strings.Repeat("ab", 32),
+		Keys:      []configSessionKey{{ID: 1, Secret: strings.Repeat("cd", 32)}},
+		ActiveKey: 1,
+		Clubs: []configClub{
+			{Name: "клуб", ID: "100", AccessToken: "token", AlbumID: "1", PhotoID: "2", VideoID: "3", MarketID: "4"},
+		},
+	}
+	blob, err := encodePairing(want, passphrase)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !strings.HasPrefix(blob, pairingPrefix) {
+		t.Fatalf("got %v, want prefix %v", blob, pairingPrefix)
+	}
+
+	got, err := decodePairing(" "+blob+"\n", passphrase)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !reflect.DeepEqual(got, want) {
+		t.Fatalf("got %+v, want %+v", got, want)
+	}
+
+	if _, err := decodePairing(blob, passphrase+"x"); err == nil {
+		t.Fatal("blob is decoded with wrong passphrase")
+	}
+
+	if _, err := decodePairing(strings.TrimPrefix(blob, pairingPrefix), passphrase); err == nil {
+		t.Fatal("blob without prefix is decoded")
+	}
+}
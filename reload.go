@@ -0,0 +1,279 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"os"
+	"os/signal"
+	"reflect"
+	"slices"
+	"sync"
+	"syscall"
+)
+
+var reloadPath string
+var reloadMu sync.Mutex
+
+type reloadedTunnel struct {
+	tunnel *tunnel
+	config config
+}
+
+// All tunnels are validated before any of them is changed,
+// so failed reload leaves every tunnel as it was.
+func reloadConfig() (config, error) {
+	reloadMu.Lock()
+	defer reloadMu.Unlock()
+
+	cfg, err := parseConfig(reloadPath)
+
+	if err != nil {
+		return config{}, fmt.Errorf("parse config: %v", err)
+	}
+
+	if err := validateConfig(cfg); err != nil {
+		return config{}, fmt.Errorf("validate config: %v", err)
+	}
+
+	list := []reloadedTunnel{}
+	names := []string{}
+
+	for _, tc := range cfg.tunnels() {
+		names = append(names, tc.Name)
+		t, exists := findTunnel(tc.Name)
+
+		if !exists {
+			slog.Warn("reload: restart required", "tunnel", tc.Name)
+			continue
+		}
+
+		if err := validateReload(t.loadConfig(), tc.Config); err != nil {
+			return config{}, tunnelError(tc.Name, err)
+		}
+
+		list = append(list, reloadedTunnel{t, tc.Config})
+	}
+
+	for _, t := range tunnels {
+		if !slices.Contains(names, t.name) {
+			slog.Warn("reload: restart required", "tunnel", t.name)
+		}
+	}
+
+	for i, r := range list {
+		for _, section := range restartRequired(r.tunnel.loadConfig(), r.config) {
+			if !slices.Contains(processSections, section) {
+				r.tunnel.logger().Warn("reload: restart required", "section", section)
+			} else if i == 0 {
+				slog.Warn("reload: restart required", "section", section)
+			}
+		}
+	}
+
+	for _, r := range list {
+		r.tunnel.storeConfig(r.config)
+
+		select {
+		case r.tunnel.reloaded <- struct{}{}:
+		default:
+		}
+	}
+
+	setLogLevel(cfg.Log.Level)
+
+	clubs, users := countTunnels(cfg)
+	slog.Info("reload: done", "tunnels", len(list), "clubs", clubs, "users", users)
+
+	return cfg, nil
+}
+
+func validateReload(old config, cfg config) error {
+	apiChanged := isAPIChanged(old.API, cfg.API)
+
+	if cfg.QR != old.QR {
+		if err := validateQR(cfg.QR); err != nil {
+			return fmt.Errorf("validate qr: %v", err)
+		}
+	}
+
+	for _, club := range cfg.Clubs {
+		if !apiChanged && slices.Contains(old.Clubs, club) {
+			continue
+		}
+
+		if err := validateClub(cfg.API, club); err != nil {
+			return fmt.Errorf("validate club: %v: %v", club.Name, err)
+		}
+
+		if err := validateLongPoll(cfg.API, club); err != nil {
+			return fmt.Errorf("validate long poll: %v: %v", club.Name, err)
+		}
+	}
+
+	for _, user := range cfg.Users {
+		if !apiChanged && slices.Contains(old.Users, user) {
+			continue
+		}
+
+		if err := validateUser(cfg.API, user); err != nil {
+			return fmt.Errorf("validate user: %v: %v", user.Name, err)
+		}
+	}
+
+	return nil
+}
+
+func countTunnels(cfg config) (int, int) {
+	clubs := 0
+	users := 0
+
+	for _, tc := range cfg.tunnels() {
+		clubs += len(tc.Config.Clubs)
+		users += len(tc.Config.Users)
+	}
+
+	return clubs, users
+}
+
+func isAPIChanged(a configAPI, b configAPI) bool {
+	a.Client = nil
+	b.Client = nil
+
+	return a != b
+}
+
+// Sections that are read once by listeners on startup.
+func restartRequired(old config, cfg config) []string {
+	old.Log.Level = cfg.Log.Level
+	sections := []struct {
+		name string
+		a    any
+		b    any
+	}{
+		{"log", old.Log, cfg.Log},
+		{"dns", old.DNS, cfg.DNS},
+		{"dnsServer", old.DNSServer, cfg.DNSServer},
+		{"socks", old.Socks, cfg.Socks},
+		{"routing", old.Routing, cfg.Routing},
+		{"transparent", old.Transparent, cfg.Transparent},
+		{"forwards", old.Forwards, cfg.Forwards},
+		{"acl", old.ACL, cfg.ACL},
+		{"session.device", old.Session.Device, cfg.Session.Device},
+		{"upstream", old.Upstream, cfg.Upstream},
+		{"metrics", old.Metrics, cfg.Metrics},
+		{"admin", old.Admin, cfg.Admin},
+		{"trace", old.Trace, cfg.Trace},
+	}
+	names := []string{}
+
+	for _, section := range sections {
+		if !reflect.DeepEqual(section.a, section.b) {
+			names = append(names, section.name)
+		}
+	}
+
+	return names
+}
+
+func listenReload(ctx context.Context) error {
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGHUP)
+	defer signal.Stop(signals)
+
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-signals:
+			slog.Info("reload: signal")
+
+			if _, err := reloadConfig(); err != nil {
+				slog.Error("reload: config", "err", err)
+			}
+		}
+	}
+}
+
+type clubListener struct {
+	club   configClub
+	api    configAPI
+	cancel context.CancelFunc
+	done   chan struct{}
+}
+
+func superviseClubs(ctx context.Context, t *tunnel, errs chan<- error) error {
+	listeners := map[string]*clubListener{}
+
+	for {
+		cfg := t.loadConfig()
+
+		for name, l := range listeners {
+			i := slices.IndexFunc(cfg.Clubs, func(club configClub) bool {
+				return club.Name == name
+			})
+
+			if i >= 0 && cfg.Clubs[i] == l.club && !isAPIChanged(cfg.API, l.api) {
+				continue
+			}
+
+			t.logger().Info("reload: stop club", "club", name)
+			l.cancel()
+			<-l.done
+			delete(listeners, name)
+		}
+
+		for _, club := range cfg.Clubs {
+			if _, exists := listeners[club.Name]; !exists {
+				listeners[club.Name] = startClubListener(ctx, t, cfg, club, errs)
+			}
+		}
+
+		select {
+		case <-ctx.Done():
+			for _, l := range listeners {
+				<-l.done
+			}
+
+			return nil
+		case <-t.reloaded:
+		}
+	}
+}
+
+func startClubListener(ctx context.Context, t *tunnel, cfg config, club configClub, errs chan<- error) *clubListener {
+	ctx, cancel := context.WithCancel(ctx)
+	l := &clubListener{
+		club:   club,
+		api:    cfg.API,
+		cancel: cancel,
+		done:   make(chan struct{}),
+	}
+
+	var wg sync.WaitGroup
+
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+
+		if err := listenLongPoll(ctx, t, cfg, club); err != nil {
+			errs <- t.wrapError(fmt.Errorf("listen long poll: %v", err))
+		}
+	}()
+
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+
+		if err := listenStorage(ctx, t, cfg, club); err != nil {
+			errs <- t.wrapError(fmt.Errorf("listen storage: %v", err))
+		}
+	}()
+
+	go func() {
+		wg.Wait()
+		close(l.done)
+	}()
+
+	return l
+}
@@ -0,0 +1,216 @@
+package main
+
+import (
+	"compress/gzip"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	rotateTimeFormat    = "20060102-150405.000"
+	rotateRetryInterval = time.Minute
+)
+
+type rotateWriter struct {
+	name     string
+	cfg      configLogRotate
+	mu       sync.Mutex
+	f        *os.File
+	size     int64
+	openedAt time.Time
+	retryAt  time.Time
+	cleanMu  sync.Mutex
+}
+
+func openRotateWriter(name string, cfg configLogRotate) (*rotateWriter, error) {
+	w := &rotateWriter{
+		name: name,
+		cfg:  cfg,
+	}
+
+	if err := w.open(); err != nil {
+		return nil, err
+	}
+
+	go w.clean()
+
+	return w, nil
+}
+
+func (w *rotateWriter) open() error {
+	f, err := os.OpenFile(w.name, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+
+	if err != nil {
+		return err
+	}
+
+	info, err := f.Stat()
+
+	if err != nil {
+		f.Close()
+		return err
+	}
+
+	w.f = f
+	w.size = info.Size()
+	w.openedAt = time.Now()
+
+	return nil
+}
+
+func (w *rotateWriter) Write(p []byte) (int, error) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	if w.shouldRotate(len(p)) {
+		if err := w.rotate(); err != nil {
+			return 0, err
+		}
+	}
+
+	n, err := w.f.Write(p)
+	w.size += int64(n)
+
+	return n, err
+}
+
+func (w *rotateWriter) shouldRotate(n int) bool {
+	if w.size == 0 || time.Now().Before(w.retryAt) {
+		return false
+	}
+
+	if w.cfg.MaxSize > 0 && w.size+int64(n) > int64(w.cfg.MaxSize)*1024*1024 {
+		return true
+	}
+
+	if w.cfg.MaxAgeMS > 0 && time.Since(w.openedAt) >= w.cfg.MaxAge() {
+		return true
+	}
+
+	return false
+}
+
+// If the file can't be renamed, for example on Windows while another
+// process holds it, writing continues to the same file and rotation
+// is retried later.
+func (w *rotateWriter) rotate() error {
+	if err := w.f.Close(); err != nil {
+		return err
+	}
+
+	backup := w.name + "." + time.Now().Format(rotateTimeFormat)
+	renameErr := os.Rename(w.name, backup)
+	openedAt := w.openedAt
+
+	if err := w.open(); err != nil {
+		return err
+	}
+
+	if renameErr != nil {
+		w.openedAt = openedAt
+		w.retryAt = time.Now().Add(rotateRetryInterval)
+		return nil
+	}
+
+	go w.clean()
+
+	return nil
+}
+
+func (w *rotateWriter) backups() ([]string, error) {
+	dir := filepath.Dir(w.name)
+	prefix := filepath.Base(w.name) + "."
+	entries, err := os.ReadDir(dir)
+
+	if err != nil {
+		return nil, err
+	}
+
+	backups := []string{}
+
+	for _, entry := range entries {
+		if entry.IsDir() || !strings.HasPrefix(entry.Name(), prefix) {
+			continue
+		}
+
+		suffix := strings.TrimSuffix(strings.TrimPrefix(entry.Name(), prefix), ".gz")
+
+		if _, err := time.Parse(rotateTimeFormat, suffix); err == nil {
+			backups = append(backups, filepath.Join(dir, entry.Name()))
+		}
+	}
+
+	sort.Strings(backups)
+
+	return backups, nil
+}
+
+func (w *rotateWriter) clean() {
+	w.cleanMu.Lock()
+	defer w.cleanMu.Unlock()
+
+	backups, err := w.backups()
+
+	if err != nil {
+		return
+	}
+
+	if w.cfg.MaxBackups > 0 && len(backups) > w.cfg.MaxBackups {
+		for _, name := range backups[:len(backups)-w.cfg.MaxBackups] {
+			os.Remove(name)
+		}
+
+		backups = backups[len(backups)-w.cfg.MaxBackups:]
+	}
+
+	if !w.cfg.Compress {
+		return
+	}
+
+	for _, name := range backups {
+		if strings.HasSuffix(name, ".gz") {
+			continue
+		}
+
+		if err := compressFile(name); err == nil {
+			os.Remove(name)
+		}
+	}
+}
+
+func compressFile(name string) error {
+	src, err := os.Open(name)
+
+	if err != nil {
+		return err
+	}
+
+	defer src.Close()
+
+	dst, err := os.OpenFile(name+".gz", os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0644)
+
+	if err != nil {
+		return err
+	}
+
+	zw := gzip.NewWriter(dst)
+
+	if _, err := io.Copy(zw, src); err != nil {
+		dst.Close()
+		os.Remove(name + ".gz")
+		return err
+	}
+
+	if err := zw.Close(); err != nil {
+		dst.Close()
+		os.Remove(name + ".gz")
+		return err
+	}
+
+	return dst.Close()
+}
@@ -0,0 +1,449 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	ruleActionAllow  = "allow"
+	ruleActionDeny   = "deny"
+	ruleActionDirect = "direct"
+	ruleActionTunnel = "tunnel"
+)
+
+var vkDomains = []string{
+	"vk.com",
+	"vk.ru",
+	"vk.me",
+	"vkontakte.ru",
+	"userapi.com",
+	"vk-cdn.net",
+	"vkuser.net",
+	"vkuseraudio.net",
+	"vkuservideo.net",
+	"vk-portal.net",
+	"vkvideo.ru",
+}
+
+var errACLDenied = errors.New("denied by acl")
+
+var aclPrivateCIDRs = []string{
+	"0.0.0.0/8",
+	"127.0.0.0/8",
+	"10.0.0.0/8",
+	"172.16.0.0/12",
+	"192.168.0.0/16",
+	"169.254.0.0/16",
+	"::/128",
+	"::1/128",
+	"fc00::/7",
+	"fe80::/10",
+}
+
+type rule struct {
+	action  string
+	domains []string
+	nets    []*net.IPNet
+	ports   [][2]uint16
+	resolve bool
+}
+
+type ruleSet struct {
+	action string
+	rules  []rule
+}
+
+func newRuleSet(action string, rules []configRule, actions []string) (ruleSet, error) {
+	rs := ruleSet{
+		action: action,
+	}
+
+	if !slices.Contains(actions, action) {
+		return ruleSet{}, fmt.Errorf("unknown action: %v", action)
+	}
+
+	for i, cfg := range rules {
+		r, err := newRule(cfg, actions)
+
+		if err != nil {
+			return ruleSet{}, fmt.Errorf("rule %v: %v", i, err)
+		}
+
+		rs.rules = append(rs.rules, r)
+	}
+
+	return rs, nil
+}
+
+func newRule(cfg configRule, actions []string) (rule, error) {
+	r := rule{
+		action:  cfg.Action,
+		resolve: cfg.Resolve,
+	}
+
+	if !slices.Contains(actions, cfg.Action) {
+		return rule{}, fmt.Errorf("unknown action: %v", cfg.Action)
+	}
+
+	domains := cfg.Domains
+	cidrs := cfg.CIDRs
+
+	for _, file := range cfg.Files {
+		fileDomains, fileCIDRs, err := readRuleFile(file)
+
+		if err != nil {
+			return rule{}, err
+		}
+
+		domains = append(domains, fileDomains...)
+		cidrs = append(cidrs, fileCIDRs...)
+	}
+
+	for _, domain := range domains {
+		domain = strings.ToLower(strings.Trim(domain, "."))
+
+		if len(domain) > 0 {
+			r.domains = append(r.domains, domain)
+		}
+	}
+
+	for _, cidr := range cidrs {
+		ipNet, err := parseCIDR(cidr)
+
+		if err != nil {
+			return rule{}, err
+		}
+
+		r.nets = append(r.nets, ipNet)
+	}
+
+	for _, port := range cfg.Ports {
+		ports, err := parsePortRange(port)
+
+		if err != nil {
+			return rule{}, err
+		}
+
+		r.ports = append(r.ports, ports)
+	}
+
+	return r, nil
+}
+
+func readRuleFile(name string) ([]string, []string, error) {
+	data, err := os.ReadFile(name)
+
+	if err != nil {
+		return nil, nil, err
+	}
+
+	domains := []string{}
+	cidrs := []string{}
+
+	for _, line := range strings.Split(string(data), "\n") {
+		line, _, _ = strings.Cut(line, "#")
+		line = strings.TrimSpace(line)
+
+		if len(line) == 0 {
+			continue
+		}
+
+		if _, err := parseCIDR(line); err == nil {
+			cidrs = append(cidrs, line)
+		} else {
+			domains = append(domains, line)
+		}
+	}
+
+	return domains, cidrs, nil
+}
+
+func parseCIDR(s string) (*net.IPNet, error) {
+	if !strings.Contains(s, "/") {
+		ip := net.ParseIP(s)
+
+		if ip == nil {
+			return nil, fmt.Errorf("invalid ip: %v", s)
+		}
+
+		if ip4 := ip.To4(); ip4 != nil {
+			return &net.IPNet{IP: ip4, Mask: net.CIDRMask(32, 32)}, nil
+		}
+
+		return &net.IPNet{IP: ip, Mask: net.CIDRMask(128, 128)}, nil
+	}
+
+	_, ipNet, err := net.ParseCIDR(s)
+
+	return ipNet, err
+}
+
+func parsePortRange(s string) ([2]uint16, error) {
+	first, last, found := strings.Cut(s, "-")
+
+	if !found {
+		last = first
+	}
+
+	from, err := strconv.ParseUint(strings.TrimSpace(first), 10, 16)
+
+	if err != nil {
+		return [2]uint16{}, fmt.Errorf("invalid port: %v", s)
+	}
+
+	to, err := strconv.ParseUint(strings.TrimSpace(last), 10, 16)
+
+	if err != nil || to < from {
+		return [2]uint16{}, fmt.Errorf("invalid port: %v", s)
+	}
+
+	return [2]uint16{uint16(from), uint16(to)}, nil
+}
+
+func (rs ruleSet) isEmpty() bool {
+	return len(rs.rules) == 0
+}
+
+func (rs ruleSet) hasNets() bool {
+	for _, r := range rs.rules {
+		if len(r.nets) > 0 {
+			return true
+		}
+	}
+
+	return false
+}
+
+func (rs ruleSet) hasResolve() bool {
+	for _, r := range rs.rules {
+		if len(r.nets) > 0 && r.resolve {
+			return true
+		}
+	}
+
+	return false
+}
+
+func (rs ruleSet) match(host string, ip net.IP, port uint16) string {
+	for _, r := range rs.rules {
+		if r.match(host, ip, port) {
+			return r.action
+		}
+	}
+
+	return rs.action
+}
+
+func (r rule) match(host string, ip net.IP, port uint16) bool {
+	if len(r.domains) > 0 && !r.matchDomain(host) {
+		return false
+	}
+
+	if len(r.nets) > 0 && !r.matchIP(ip) {
+		return false
+	}
+
+	if len(r.ports) > 0 && !r.matchPort(port) {
+		return false
+	}
+
+	return true
+}
+
+func (r rule) matchDomain(host string) bool {
+	host = strings.ToLower(strings.TrimSuffix(host, "."))
+
+	for _, domain := range r.domains {
+		if host == domain || strings.HasSuffix(host, "."+domain) {
+			return true
+		}
+	}
+
+	return false
+}
+
+func (r rule) matchIP(ip net.IP) bool {
+	if ip == nil {
+		return false
+	}
+
+	for _, ipNet := range r.nets {
+		if ipNet.Contains(ip) {
+			return true
+		}
+	}
+
+	return false
+}
+
+func (r rule) matchPort(port uint16) bool {
+	for _, ports := range r.ports {
+		if port >= ports[0] && port <= ports[1] {
+			return true
+		}
+	}
+
+	return false
+}
+
+// Built-in rules go before configured ones. Admin and metrics ports
+// of the device are always denied, local networks unless allowPrivate.
+func aclBuiltinRules(cfg config) []configRule {
+	rules := []configRule{}
+	ports := []string{}
+
+	if cfg.Admin.Port != 0 {
+		ports = append(ports, strconv.Itoa(int(cfg.Admin.Port)))
+	}
+
+	if cfg.Metrics.Port != 0 {
+		ports = append(ports, strconv.Itoa(int(cfg.Metrics.Port)))
+	}
+
+	if len(ports) > 0 {
+		rules = append(rules,
+			configRule{Action: ruleActionDeny, CIDRs: localCIDRs(), Ports: ports},
+			configRule{Action: ruleActionDeny, Domains: []string{"localhost"}, Ports: ports},
+		)
+	}
+
+	if !cfg.ACL.AllowPrivate {
+		rules = append(rules,
+			configRule{Action: ruleActionDeny, CIDRs: aclPrivateCIDRs},
+			configRule{Action: ruleActionDeny, Domains: []string{"localhost"}},
+		)
+	}
+
+	return rules
+}
+
+// Addresses of the device itself, services may listen on any of them.
+func localCIDRs() []string {
+	cidrs := []string{"0.0.0.0/8", "127.0.0.0/8", "::/128", "::1/128"}
+	addrs, err := net.InterfaceAddrs()
+
+	if err != nil {
+		return cidrs
+	}
+
+	for _, addr := range addrs {
+		if ipNet, ok := addr.(*net.IPNet); ok {
+			cidrs = append(cidrs, ipNet.IP.String())
+		}
+	}
+
+	return cidrs
+}
+
+func (cfg configACL) ruleSet(device dgDev) ruleSet {
+	for _, dev := range cfg.Devices {
+		if dgDev(dev.Device) == device {
+			return dev.RuleSet
+		}
+	}
+
+	return cfg.RuleSet
+}
+
+// Domain is resolved only if it will be dialed directly, domains passed
+// to upstream proxy are checked by name and port only.
+func checkACL(cfg configACL, device dgDev, addr address, resolve bool) (address, error) {
+	rs := cfg.ruleSet(device)
+
+	if rs.isEmpty() && rs.action == ruleActionAllow {
+		return addr, nil
+	}
+
+	ip := net.ParseIP(addr.host)
+
+	if ip != nil {
+		if rs.match("", ip, addr.port) != ruleActionAllow {
+			return address{}, errACLDenied
+		}
+
+		return addr, nil
+	}
+
+	if !rs.hasNets() || !resolve {
+		if rs.match(addr.host, nil, addr.port) != ruleActionAllow {
+			return address{}, errACLDenied
+		}
+
+		return addr, nil
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	ips, err := net.DefaultResolver.LookupIP(ctx, "ip", addr.host)
+
+	if err != nil {
+		return address{}, err
+	}
+
+	for _, ip := range ips {
+		if rs.match(addr.host, ip, addr.port) == ruleActionAllow {
+			return address{ip.String(), addr.port}, nil
+		}
+	}
+
+	return address{}, errACLDenied
+}
+
+// Domain is matched by name first. It's resolved locally only if no rule
+// matched and some rule with cidrs has resolve, so other hostnames don't
+// leak to local DNS. Only cidrs of such rules are matched against resolved
+// addresses, and request goes direct only if all of them are direct.
+func routeAddress(cfg configRouting, addr address) (string, address) {
+	rs := cfg.RuleSet
+	ip := net.ParseIP(addr.host)
+
+	if ip != nil {
+		return rs.match("", ip, addr.port), addr
+	}
+
+	for _, r := range rs.rules {
+		if r.match(addr.host, nil, addr.port) {
+			return r.action, addr
+		}
+	}
+
+	if !rs.hasResolve() {
+		return rs.action, addr
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	ips, err := net.DefaultResolver.LookupIP(ctx, "ip", addr.host)
+
+	if err != nil || len(ips) == 0 {
+		return rs.action, addr
+	}
+
+	for _, ip := range ips {
+		if rs.matchResolved(addr.host, ip, addr.port) != ruleActionDirect {
+			return ruleActionTunnel, addr
+		}
+	}
+
+	return ruleActionDirect, address{ips[0].String(), addr.port}
+}
+
+func (rs ruleSet) matchResolved(host string, ip net.IP, port uint16) string {
+	for _, r := range rs.rules {
+		if len(r.nets) > 0 && r.resolve && r.match(host, ip, port) {
+			return r.action
+		}
+	}
+
+	return rs.action
+}
@@ -0,0 +1,89 @@
+package main
+
+import (
+	"errors"
+	"net"
+	"testing"
+)
+
+func TestCheckACL(t *testing.T) {
+	cfg := defaultConfig()
+	cfg.Admin.Port = 8081
+	cfg.ACL.Devices = []configACLDevice{
+		{Device: 7, Default: ruleActionDeny, Rules: []configRule{
+			{Action: ruleActionAllow, Ports: []string{"443"}},
+		}},
+	}
+
+	if err := prepareConfig(&cfg, ""); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		device dgDev
+		addr   address
+		err    error
+	}{
+		{1, address{"1.1.1.1", 80}, nil},
+		{1, address{"127.0.0.1", 22}, errACLDenied},
+		{1, address{"192.168.1.1", 80}, errACLDenied},
+		{1, address{"fe80::1", 80}, errACLDenied},
+		{1, address{"localhost", 22}, errACLDenied},
+		{7, address{"1.1.1.1", 443}, nil},
+		{7, address{"1.1.1.1", 80}, errACLDenied},
+		{7, address{"10.0.0.1", 443}, errACLDenied},
+	}
+
+	for _, tt := range tests {
+		if _, err := checkACL(cfg.ACL, tt.device, tt.addr, false); !errors.Is(err, tt.err) {
+			t.Fatalf("device %v, %v: got %v, want %v", tt.device, tt.addr, err, tt.err)
+		}
+	}
+
+	cfg.ACL.AllowPrivate = true
+
+	if err := prepareConfig(&cfg, ""); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := checkACL(cfg.ACL, 1, address{"192.168.1.1", 80}, false); err != nil {
+		t.Fatalf("private address is denied: %v", err)
+	}
+
+	if _, err := checkACL(cfg.ACL, 1, address{"127.0.0.1", 8081}, false); !errors.Is(err, errACLDenied) {
+		t.Fatalf("admin port is allowed: %v", err)
+	}
+}
+
+func TestRouteAddress(t *testing.T) {
+	loopback := []string{"127.0.0.0/8", "::1"}
+	tests := []struct {
+		rules  []configRule
+		addr   address
+		action string
+	}{
+		{[]configRule{{Action: ruleActionDirect, Domains: []string{"localhost"}}}, address{"localhost", 80}, ruleActionDirect},
+		{[]configRule{{Action: ruleActionDirect, CIDRs: loopback}}, address{"localhost", 80}, ruleActionTunnel},
+		{[]configRule{{Action: ruleActionDirect, CIDRs: loopback, Resolve: true}}, address{"localhost", 80}, ruleActionDirect},
+		{[]configRule{{Action: ruleActionDirect, CIDRs: []string{"10.0.0.0/8"}, Resolve: true}}, address{"localhost", 80}, ruleActionTunnel},
+		{[]configRule{{Action: ruleActionDirect, CIDRs: loopback}}, address{"127.0.0.1", 80}, ruleActionDirect},
+	}
+
+	for i, tt := range tests {
+		rs, err := newRuleSet(ruleActionTunnel, tt.rules, []string{ruleActionDirect, ruleActionTunnel})
+
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		action, dial := routeAddress(configRouting{RuleSet: rs}, tt.addr)
+
+		if action != tt.action {
+			t.Fatalf("%v: got %v, want %v", i, action, tt.action)
+		}
+
+		if action == ruleActionDirect && net.ParseIP(dial.host) == nil && len(tt.rules[0].CIDRs) > 0 {
+			t.Fatalf("%v: got %v, want resolved address", i, dial)
+		}
+	}
+}
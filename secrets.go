@@ -0,0 +1,233 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+)
+
+type configSecrets struct {
+	Secret string            `json:"secret"`
+	Clubs  map[string]string `json:"clubs"`
+	Users  map[string]string `json:"users"`
+}
+
+var envPattern = regexp.MustCompile(`\$\{([A-Za-z_][A-Za-z0-9_]*)\}`)
+
+// Values like "${NAME}" are replaced with environment variable NAME.
+// If NAME is not set, then content of the file at NAME_FILE is used.
+func expandEnv(data []byte) ([]byte, error) {
+	var v any
+
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.UseNumber()
+
+	if err := dec.Decode(&v); err != nil {
+		return nil, err
+	}
+
+	v, err := expandEnvValue(v)
+
+	if err != nil {
+		return nil, err
+	}
+
+	return json.Marshal(v)
+}
+
+func expandEnvValue(v any) (any, error) {
+	switch v := v.(type) {
+	case string:
+		return expandEnvString(v)
+	case []any:
+		for i := range v {
+			expanded, err := expandEnvValue(v[i])
+
+			if err != nil {
+				return nil, err
+			}
+
+			v[i] = expanded
+		}
+	case map[string]any:
+		for key := range v {
+			expanded, err := expandEnvValue(v[key])
+
+			if err != nil {
+				return nil, err
+			}
+
+			v[key] = expanded
+		}
+	}
+
+	return v, nil
+}
+
+func expandEnvString(s string) (string, error) {
+	var expandErr error
+
+	expanded := envPattern.ReplaceAllStringFunc(s, func(ref string) string {
+		name := envPattern.FindStringSubmatch(ref)[1]
+		value, err := lookupEnv(name)
+
+		if err != nil && expandErr == nil {
+			expandErr = err
+		}
+
+		return value
+	})
+
+	return expanded, expandErr
+}
+
+func lookupEnv(name string) (string, error) {
+	if value, exists := os.LookupEnv(name); exists {
+		return value, nil
+	}
+
+	path, exists := os.LookupEnv(name + "_FILE")
+
+	if !exists {
+		return "", fmt.Errorf("%v is not set", name)
+	}
+
+	data, err := os.ReadFile(path)
+
+	if err != nil {
+		return "", fmt.Errorf("%v_FILE: %v", name, err)
+	}
+
+	return strings.TrimRight(string(data), "\r\n"), nil
+}
+
+func readSecrets(cfg config, configPath string) (configSecrets, error) {
+	path := cfg.Secrets
+
+	if !filepath.IsAbs(path) {
+		path = filepath.Join(filepath.Dir(configPath), path)
+	}
+
+	data, err := os.ReadFile(path)
+
+	if err != nil {
+		return configSecrets{}, err
+	}
+
+	data, err = expandEnv(data)
+
+	if err != nil {
+		return configSecrets{}, err
+	}
+
+	secrets := configSecrets{}
+
+	if err := json.Unmarshal(data, &secrets); err != nil {
+		return configSecrets{}, err
+	}
+
+	return secrets, nil
+}
+
+// Secrets file inherited from top level config is shared by tunnels,
+// so each tunnel takes only entries it knows. Unknown names are
+// checked once by checkSharedSecrets.
+func applySecrets(cfg *config, configPath string) error {
+	secrets, err := readSecrets(*cfg, configPath)
+
+	if err != nil {
+		return err
+	}
+
+	if len(secrets.Secret) > 0 {
+		cfg.Session.Secret = secrets.Secret
+	}
+
+	for name, token := range secrets.Clubs {
+		found := false
+
+		for i := range cfg.Clubs {
+			if cfg.Clubs[i].Name == name {
+				cfg.Clubs[i].AccessToken = token
+				found = true
+			}
+		}
+
+		if !found && !cfg.SharedSecrets {
+			return fmt.Errorf("unknown club: %v", name)
+		}
+	}
+
+	for name, token := range secrets.Users {
+		found := false
+
+		for i := range cfg.Users {
+			if cfg.Users[i].Name == name {
+				cfg.Users[i].AccessToken = token
+				found = true
+			}
+		}
+
+		if !found && !cfg.SharedSecrets {
+			return fmt.Errorf("unknown user: %v", name)
+		}
+	}
+
+	return nil
+}
+
+// Every name in shared secrets file must be known to at least
+// one of the tunnels that inherit it.
+func checkSharedSecrets(cfg config, configPath string) error {
+	if len(cfg.Secrets) == 0 {
+		return nil
+	}
+
+	clubs := map[string]bool{}
+	users := map[string]bool{}
+	shared := false
+
+	for _, tc := range cfg.TunnelConfigs {
+		if !tc.Config.SharedSecrets {
+			continue
+		}
+
+		shared = true
+
+		for _, club := range tc.Config.Clubs {
+			clubs[club.Name] = true
+		}
+
+		for _, user := range tc.Config.Users {
+			users[user.Name] = true
+		}
+	}
+
+	if !shared {
+		return nil
+	}
+
+	secrets, err := readSecrets(cfg, configPath)
+
+	if err != nil {
+		return err
+	}
+
+	for name := range secrets.Clubs {
+		if !clubs[name] {
+			return fmt.Errorf("unknown club: %v", name)
+		}
+	}
+
+	for name := range secrets.Users {
+		if !users[name] {
+			return fmt.Errorf("unknown user: %v", name)
+		}
+	}
+
+	return nil
+}
@@ -6,9 +6,12 @@ import (
 	"errors"
 	"fmt"
 	"log/slog"
+	"math"
 	"math/rand"
 	"net"
 	"net/url"
+	"slices"
+	"strconv"
 	"strings"
 	"sync"
 	"time"
@@ -34,15 +37,36 @@ const (
 var (
 	errSessionClosed    = errors.New("session is closed")
 	errSessionQueueFull = errors.New("session queue is full")
+	errConnectTimeout   = errors.New("connect timeout")
+	errResolveTimeout   = errors.New("resolve timeout")
 )
 
-var methodsEnabled = map[int]bool{}
-var methodsEncoding = map[int]int{}
-var methodsMaxLenEncoded = map[int]int{}
-var methodsMaxLenPayload = map[int]int{}
+var methodNames = map[int]string{
+	methodMessage:       "message",
+	methodPost:          "post",
+	methodPostComment:   "post_comment",
+	methodDoc:           "doc",
+	methodQR:            "qr",
+	methodCaption:       "caption",
+	methodStorage:       "storage",
+	methodDescription:   "description",
+	methodWebsite:       "website",
+	methodVideoComment:  "video_comment",
+	methodPhotoComment:  "photo_comment",
+	methodMarketComment: "market_comment",
+	methodTopic:         "topic",
+	methodTopicComment:  "topic_comment",
+}
+
+type methodSettings struct {
+	enabled       map[int]bool
+	encoding      map[int]int
+	maxLenEncoded map[int]int
+	maxLenPayload map[int]int
+}
 
-func initSession(cfg config) error {
-	methodsEnabled = map[int]bool{
+func newMethodSettings(cfg config) *methodSettings {
+	enabled := map[int]bool{
 		methodMessage:       true,
 		methodPost:          true,
 		methodPostComment:   true,
@@ -58,7 +82,7 @@ func initSession(cfg config) error {
 		methodTopic:         false && !cfg.API.Unathorized, // disabled, captcha control
 		methodTopicComment:  false && !cfg.API.Unathorized, // disabled, captcha control
 	}
-	methodsEncoding = map[int]int{
+	encoding := map[int]int{
 		methodMessage:       datagramEncodingRU,
 		methodPost:          datagramEncodingRU,
 		methodPostComment:   datagramEncodingRU,
@@ -74,7 +98,7 @@ func initSession(cfg config) error {
 		methodTopic:         datagramEncodingRU,
 		methodTopicComment:  datagramEncodingRU,
 	}
-	methodsMaxLenEncoded = map[int]int{
+	maxLenEncoded := map[int]int{
 		methodMessage:       4096,
 		methodPost:          16000,
 		methodPostComment:   16000,
@@ -90,51 +114,64 @@ func initSession(cfg config) error {
 		methodTopic:         4096,
 		methodTopicComment:  4096,
 	}
-	methodsMaxLenPayload = map[int]int{
-		methodMessage:       datagramCalcMaxLen(methodsMaxLenEncoded[methodMessage] - datagramHeaderLenEncoded),
-		methodPost:          datagramCalcMaxLen(methodsMaxLenEncoded[methodPost] - datagramHeaderLenEncoded),
-		methodPostComment:   datagramCalcMaxLen(methodsMaxLenEncoded[methodPostComment] - datagramHeaderLenEncoded),
-		methodDoc:           datagramCalcMaxLen(methodsMaxLenEncoded[methodDoc] - datagramHeaderLenEncoded),
-		methodQR:            datagramCalcMaxLen(methodsMaxLenEncoded[methodQR] - datagramHeaderLenEncoded),
-		methodCaption:       datagramCalcMaxLen(methodsMaxLenEncoded[methodCaption] - datagramHeaderLenEncoded),
-		methodStorage:       datagramCalcMaxLen(methodsMaxLenEncoded[methodStorage] - datagramHeaderLenEncoded),
-		methodDescription:   datagramCalcMaxLen(methodsMaxLenEncoded[methodDescription] - datagramHeaderLenEncoded),
-		methodWebsite:       datagramCalcMaxLen(methodsMaxLenEncoded[methodWebsite] - datagramHeaderLenEncoded),
-		methodVideoComment:  datagramCalcMaxLen(methodsMaxLenEncoded[methodVideoComment] - datagramHeaderLenEncoded),
-		methodPhotoComment:  datagramCalcMaxLen(methodsMaxLenEncoded[methodPhotoComment] - datagramHeaderLenEncoded),
-		methodMarketComment: datagramCalcMaxLen(methodsMaxLenEncoded[methodMarketComment] - datagramHeaderLenEncoded),
-		methodTopic:         datagramCalcMaxLen(methodsMaxLenEncoded[methodTopic] - datagramHeaderLenEncoded),
-		methodTopicComment:  datagramCalcMaxLen(methodsMaxLenEncoded[methodTopicComment] - datagramHeaderLenEncoded),
+	maxLenPayload := map[int]int{
+		methodMessage:       datagramCalcMaxLen(maxLenEncoded[methodMessage] - datagramHeaderLenEncoded),
+		methodPost:          datagramCalcMaxLen(maxLenEncoded[methodPost] - datagramHeaderLenEncoded),
+		methodPostComment:   datagramCalcMaxLen(maxLenEncoded[methodPostComment] - datagramHeaderLenEncoded),
+		methodDoc:           datagramCalcMaxLen(maxLenEncoded[methodDoc] - datagramHeaderLenEncoded),
+		methodQR:            datagramCalcMaxLen(maxLenEncoded[methodQR] - datagramHeaderLenEncoded),
+		methodCaption:       datagramCalcMaxLen(maxLenEncoded[methodCaption] - datagramHeaderLenEncoded),
+		methodStorage:       datagramCalcMaxLen(maxLenEncoded[methodStorage] - datagramHeaderLenEncoded),
+		methodDescription:   datagramCalcMaxLen(maxLenEncoded[methodDescription] - datagramHeaderLenEncoded),
+		methodWebsite:       datagramCalcMaxLen(maxLenEncoded[methodWebsite] - datagramHeaderLenEncoded),
+		methodVideoComment:  datagramCalcMaxLen(maxLenEncoded[methodVideoComment] - datagramHeaderLenEncoded),
+		methodPhotoComment:  datagramCalcMaxLen(maxLenEncoded[methodPhotoComment] - datagramHeaderLenEncoded),
+		methodMarketComment: datagramCalcMaxLen(maxLenEncoded[methodMarketComment] - datagramHeaderLenEncoded),
+		methodTopic:         datagramCalcMaxLen(maxLenEncoded[methodTopic] - datagramHeaderLenEncoded),
+		methodTopicComment:  datagramCalcMaxLen(maxLenEncoded[methodTopicComment] - datagramHeaderLenEncoded),
+	}
+
+	return &methodSettings{
+		enabled:       enabled,
+		encoding:      encoding,
+		maxLenEncoded: maxLenEncoded,
+		maxLenPayload: maxLenPayload,
 	}
-
-	return nil
 }
 
-var sessions map[dgSes]*session = map[dgSes]*session{}
-var sessionsMu sync.Mutex = sync.Mutex{}
-
-func getSession(id dgSes) (*session, bool) {
-	sessionsMu.Lock()
-	defer sessionsMu.Unlock()
+func (t *tunnel) getSession(id dgSes) (*session, bool) {
+	t.sessionsMu.Lock()
+	defer t.sessionsMu.Unlock()
 
-	ses, exists := sessions[id]
+	ses, exists := t.sessions[id]
 
 	return ses, exists
 }
 
-func setSession(id dgSes, ses *session) {
-	sessionsMu.Lock()
-	defer sessionsMu.Unlock()
+func (t *tunnel) setSession(id dgSes, ses *session) {
+	t.sessionsMu.Lock()
+	defer t.sessionsMu.Unlock()
 
-	sessions[id] = ses
+	t.sessions[id] = ses
 }
 
-func isSessionOpened() bool {
-	sessionsMu.Lock()
-	defer sessionsMu.Unlock()
+func (t *tunnel) forEachSession(f func(ses *session)) {
+	t.sessionsMu.Lock()
+	defer t.sessionsMu.Unlock()
 
-	for _, ses := range sessions {
+	for _, ses := range t.sessions {
 		if !ses.isClosed() {
+			f(ses)
+		}
+	}
+}
+
+func (t *tunnel) isSessionOpened() bool {
+	t.sessionsMu.Lock()
+	defer t.sessionsMu.Unlock()
+
+	for _, ses := range t.sessions {
+		if !ses.isClosed() && !ses.isDirect() {
 			return true
 		}
 	}
@@ -142,30 +179,44 @@ func isSessionOpened() bool {
 	return false
 }
 
-var sessionID dgSes = 0
-var sessionIDMu sync.Mutex = sync.Mutex{}
+func (t *tunnel) nextSessionID() dgSes {
+	t.sessionIDMu.Lock()
+	defer t.sessionIDMu.Unlock()
 
-func nextSessionID() dgSes {
-	sessionIDMu.Lock()
-	defer sessionIDMu.Unlock()
+	// Own IDs stay positive, so negated IDs of the interlocutor
+	// never collide with them. After wrap IDs still in use are skipped.
+	for {
+		if t.sessionID == math.MaxInt32 {
+			t.sessionID = 0
+		}
 
-	sessionID++
+		t.sessionID++
 
-	return sessionID
+		if _, exists := t.getSession(t.sessionID); !exists {
+			return t.sessionID
+		}
+	}
 }
 
 type session struct {
-	cfg       config
 	id        dgSes
+	tunnel    *tunnel
+	device    dgDev
+	log       *slog.Logger
+	logAttrs  []any
 	number    dgNum
 	mu        sync.Mutex
 	wg        sync.WaitGroup
 	peer      net.Conn
+	target    string
+	direct    bool
 	closed    bool
 	onClose   chan struct{}
 	history   map[dgNum]datagram
 	writes    chan []byte
 	datagrams chan datagram
+	connected chan payloadConnectResult
+	resolved  chan payloadResolveResult
 	openedAt  time.Time
 	activity  time.Time
 	posts     map[configClub]wallPostResponse
@@ -174,22 +225,27 @@ type session struct {
 	outBytes  int
 }
 
-func openSession(id dgSes, cfg config) (*session, error) {
-	slog.Debug("session: open", "id", id)
-
+func openSession(t *tunnel, id dgSes) (*session, error) {
 	now := time.Now()
 	s := &session{
-		cfg:       cfg,
 		id:        id,
+		tunnel:    t,
+		device:    0,
+		log:       nil,
+		logAttrs:  []any{"ses", id},
 		number:    0,
 		mu:        sync.Mutex{},
 		wg:        sync.WaitGroup{},
 		peer:      nil,
+		target:    "",
+		direct:    false,
 		closed:    false,
 		onClose:   make(chan struct{}),
 		history:   make(map[dgNum]datagram),
 		writes:    make(chan []byte, 500),
 		datagrams: make(chan datagram, 500),
+		connected: make(chan payloadConnectResult, 1),
+		resolved:  make(chan payloadResolveResult, 1),
 		openedAt:  now,
 		activity:  now,
 		posts:     make(map[configClub]wallPostResponse),
@@ -198,6 +254,14 @@ func openSession(id dgSes, cfg config) (*session, error) {
 		outBytes:  0,
 	}
 
+	if len(t.name) > 0 {
+		s.logAttrs = append(s.logAttrs, "tunnel", t.name)
+	}
+
+	s.log = slog.With(s.logAttrs...)
+
+	s.log.Debug("session: open")
+
 	s.wg.Add(1)
 	go func() {
 		defer s.wg.Done()
@@ -225,21 +289,17 @@ func (s *session) close() {
 		return
 	}
 
-	if s.peer == nil {
-		slog.Debug("session: close", "id", s.id)
-	} else {
-		slog.Debug("session: close", "id", s.id, "peer", s.peer.RemoteAddr().String())
-	}
-
-	slog.Debug(
+	s.log.Debug("session: close")
+	s.log.Debug(
 		"session: stats",
-		"id", s.id,
 		"in", s.inBytes,
 		"out", s.outBytes,
 		"duration", int(time.Since(s.openedAt).Seconds()),
 		"fragments", len(s.history),
 	)
 
+	metricSessionDuration.observe(time.Since(s.openedAt).Seconds(), s.tunnel.name, strconv.FormatBool(s.direct))
+
 	s.closed = true
 
 	close(s.writes)
@@ -275,7 +335,7 @@ func (s *session) isInactive() bool {
 		return false
 	}
 
-	timeout := s.cfg.Session.Timeout()
+	timeout := s.cfg().Session.Timeout()
 
 	if timeout == 0 {
 		return false
@@ -284,6 +344,10 @@ func (s *session) isInactive() bool {
 	return time.Since(s.activity) > timeout
 }
 
+func (s *session) cfg() config {
+	return s.tunnel.loadConfig()
+}
+
 func (s *session) nextNumber() dgNum {
 	s.mu.Lock()
 	defer s.mu.Unlock()
@@ -298,6 +362,76 @@ func (s *session) setPeer(conn net.Conn) {
 	defer s.mu.Unlock()
 
 	s.peer = conn
+	s.addLogAttrs("peer", conn.RemoteAddr().String())
+}
+
+func (s *session) setTarget(addr address) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.target = addr.String()
+	s.addLogAttrs("target", s.target)
+}
+
+func (s *session) setClub(club configClub) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.addLogAttrs("club", club.Name)
+}
+
+// Device of the interlocutor is known only after its first
+// datagram, so it's logged from then on.
+func (s *session) setDevice(device dgDev) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.device != 0 {
+		return
+	}
+
+	s.device = device
+	s.addLogAttrs("dev", device)
+}
+
+func (s *session) getDevice() dgDev {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.device
+}
+
+func (s *session) addLogAttrs(args ...any) {
+	s.logAttrs = append(s.logAttrs, args...)
+	s.log = s.log.With(args...)
+}
+
+func (s *session) logger() *slog.Logger {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.log
+}
+
+func (s *session) loggerAttrs() []any {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return slices.Clone(s.logAttrs)
+}
+
+func (s *session) setDirect() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.direct = true
+}
+
+func (s *session) isDirect() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.direct
 }
 
 func (s *session) getHistory(number dgNum) (datagram, bool) {
@@ -325,6 +459,7 @@ func (s *session) writePeer(b []byte) error {
 
 	s.activity = time.Now()
 	s.inBytes += len(b)
+	metricBytes.add(float64(len(b)), s.tunnel.name, "in")
 
 	select {
 	case s.writes <- clone:
@@ -334,10 +469,78 @@ func (s *session) writePeer(b []byte) error {
 	}
 }
 
+func (s *session) setConnectResult(pld payloadConnectResult) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.closed {
+		return errSessionClosed
+	}
+
+	s.activity = time.Now()
+
+	select {
+	case s.connected <- pld:
+		return nil
+	default:
+		return errors.New("connect result is already set")
+	}
+}
+
+func (s *session) waitConnectResult(timeout time.Duration) (payloadConnectResult, error) {
+	select {
+	case pld := <-s.connected:
+		return pld, nil
+	case <-s.onClose:
+		select {
+		case pld := <-s.connected:
+			return pld, nil
+		default:
+			return payloadConnectResult{}, errSessionClosed
+		}
+	case <-time.After(timeout):
+		return payloadConnectResult{}, errConnectTimeout
+	}
+}
+
+func (s *session) setResolveResult(pld payloadResolveResult) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.closed {
+		return errSessionClosed
+	}
+
+	s.activity = time.Now()
+
+	select {
+	case s.resolved <- pld:
+		return nil
+	default:
+		return errors.New("resolve result is already set")
+	}
+}
+
+func (s *session) waitResolveResult(timeout time.Duration) (payloadResolveResult, error) {
+	select {
+	case pld := <-s.resolved:
+		return pld, nil
+	case <-s.onClose:
+		select {
+		case pld := <-s.resolved:
+			return pld, nil
+		default:
+			return payloadResolveResult{}, errSessionClosed
+		}
+	case <-time.After(timeout):
+		return payloadResolveResult{}, errResolveTimeout
+	}
+}
+
 func (s *session) listenWrites() {
 	for data := range s.writes {
-		if err := writeSocks(s.cfg, s, data); err != nil {
-			slog.Error("session: write", "id", s.id, "err", err)
+		if err := writeSocks(s.cfg(), s, data); err != nil {
+			s.logger().Error("session: write", "err", err)
 		}
 	}
 }
@@ -358,6 +561,7 @@ func (s *session) sendDatagram(dg datagram) error {
 
 	s.activity = time.Now()
 	s.outBytes += len(dg.payload)
+	metricBytes.add(float64(len(dg.payload)), s.tunnel.name, "out")
 
 	select {
 	case s.datagrams <- clone:
@@ -372,7 +576,7 @@ func (s *session) listenDatagrams() {
 		methods, fragments, err := s.createPlan(dg)
 
 		if err != nil {
-			slog.Error("session: plan", "id", s.id, "dg", dg, "err", err)
+			s.logger().Error("session: plan", "dg", dg, "err", err)
 			continue
 		}
 
@@ -385,34 +589,35 @@ func (s *session) listenDatagrams() {
 		s.mu.Unlock()
 
 		if err := s.executePlan(methods, fragments); err != nil {
-			slog.Error("session: plan", "id", s.id, "dg", dg, "err", err)
+			s.logger().Error("session: plan", "dg", dg, "err", err)
 		}
 	}
 }
 
 func (s *session) createPlan(dg datagram) ([]int, []datagram, error) {
+	settings := s.tunnel.loadMethods()
 	smallMethods := []int{methodMessage, methodPost}
 	bigMethods := []int{methodDoc}
 
-	if enabled := methodsEnabled[methodQR]; enabled {
+	if enabled := settings.enabled[methodQR]; enabled {
 		smallMethods = append(smallMethods, methodQR)
-	} else if enabled := methodsEnabled[methodCaption]; enabled {
+	} else if enabled := settings.enabled[methodCaption]; enabled {
 		smallMethods = append(smallMethods, methodCaption)
 	}
 
-	if enabled := methodsEnabled[methodVideoComment]; enabled {
+	if enabled := settings.enabled[methodVideoComment]; enabled {
 		smallMethods = append(smallMethods, methodVideoComment)
 	}
 
-	if enabled := methodsEnabled[methodPhotoComment]; enabled {
+	if enabled := settings.enabled[methodPhotoComment]; enabled {
 		smallMethods = append(smallMethods, methodPhotoComment)
 	}
 
-	if enabled := methodsEnabled[methodMarketComment]; enabled {
+	if enabled := settings.enabled[methodMarketComment]; enabled {
 		smallMethods = append(smallMethods, methodMarketComment)
 	}
 
-	if enabled := methodsEnabled[methodTopic]; enabled {
+	if enabled := settings.enabled[methodTopic]; enabled {
 		smallMethods = append(smallMethods, methodTopic)
 	}
 
@@ -428,14 +633,14 @@ func (s *session) createPlan(dg datagram) ([]int, []datagram, error) {
 
 	s.mu.Unlock()
 
-	if dg.command != commandConnect {
+	if dg.command != commandConnect && dg.command != commandConnectReverse {
 		smallMethods = append(smallMethods, methodStorage, methodStorage)
 	}
 
 	methods := []int{}
 	fragments := []datagram{}
 
-	maxSmallForwardLen := min(methodsMaxLenEncoded[methodQR], methodsMaxLenEncoded[methodPhotoComment])
+	maxSmallForwardLen := min(settings.maxLenEncoded[methodQR], settings.maxLenEncoded[methodPhotoComment])
 
 	if dg.command != commandForward || dg.LenEncoded() <= maxSmallForwardLen {
 		if dg.number == 0 {
@@ -453,7 +658,7 @@ func (s *session) createPlan(dg datagram) ([]int, []datagram, error) {
 		availableMethods := []int{}
 
 		for _, m := range bigMethods {
-			if dg.LenEncoded() <= methodsMaxLenEncoded[m] {
+			if dg.LenEncoded() <= settings.maxLenEncoded[m] {
 				availableMethods = append(availableMethods, m)
 			}
 		}
@@ -471,7 +676,7 @@ func (s *session) createPlan(dg datagram) ([]int, []datagram, error) {
 
 	for len(dg.payload) > 0 {
 		method := randElem(bigMethods)
-		chunks := bytesToChunks(dg.payload, methodsMaxLenPayload[method], 2)
+		chunks := bytesToChunks(dg.payload, settings.maxLenPayload[method], 2)
 
 		if len(chunks) == 0 || len(chunks) > 2 {
 			return nil, nil, errors.New("unexpected chunks logic")
@@ -484,9 +689,9 @@ func (s *session) createPlan(dg datagram) ([]int, []datagram, error) {
 		}
 
 		num := s.nextNumber()
-		fg := newDatagram(dg.session, num, dg.command, chunks[0])
+		fg := newDatagram(s.tunnel.device, dg.session, num, dg.command, chunks[0])
 
-		if fg.LenEncoded() > methodsMaxLenEncoded[method] {
+		if fg.LenEncoded() > settings.maxLenEncoded[method] {
 			return nil, nil, errors.New("unexpected payload logic")
 		}
 
@@ -502,6 +707,7 @@ func (s *session) createPlan(dg datagram) ([]int, []datagram, error) {
 }
 
 func (s *session) executePlan(methods []int, fragments []datagram) error {
+	settings := s.tunnel.loadMethods()
 	if len(methods) != len(fragments) {
 		return errors.New("methods and fragments mismatch")
 	}
@@ -516,7 +722,7 @@ func (s *session) executePlan(methods []int, fragments []datagram) error {
 			continue
 		}
 
-		var f func(string) error
+		var f func(string) (configClub, error)
 
 		switch method {
 		case methodMessage:
@@ -549,16 +755,26 @@ func (s *session) executePlan(methods []int, fragments []datagram) error {
 			return fmt.Errorf("unknown method: %v", method)
 		}
 
-		encoded := encodeDatagram(fg, methodsEncoding[method])
-		slog.Debug("session: send", "id", s.id, "method", method, "dg", fg)
+		encoded := encodeDatagram(fg, settings.encoding[method])
+		s.logger().Debug("session: send", "method", methodNames[method], "dg", fg)
 
 		s.wg.Add(1)
 		go func(method int) {
 			defer s.wg.Done()
 
-			if err := f(encoded); err != nil {
-				slog.Error("session: send", "id", s.id, "method", method, "dg", fg, "err", err)
-			}
+			runWithFault(s.cfg().Faults.Send, fg, func() {
+				started := time.Now()
+				club, err := f(encoded)
+				recordMethodHealth(method, err)
+				traceSend(s, fg, method, club, started, err)
+
+				if err != nil {
+					s.logger().Error("session: send", "method", methodNames[method], "club", club.Name, "dg", fg, "err", err)
+					return
+				}
+
+				metricDatagramsSent.inc(s.tunnel.name, methodNames[method], club.Name)
+			})
 		}(method)
 	}
 
@@ -566,58 +782,71 @@ func (s *session) executePlan(methods []int, fragments []datagram) error {
 		encoded := make([]string, len(qrs))
 
 		for i, fg := range qrs {
-			encoded[i] = encodeDatagram(fg, methodsEncoding[methodQR])
-			slog.Debug("session: send", "id", s.id, "method", methodQR, "dg", fg)
+			encoded[i] = encodeDatagram(fg, settings.encoding[methodQR])
+			s.logger().Debug("session: send", "method", methodNames[methodQR], "dg", fg)
 		}
 
 		s.wg.Add(1)
 		go func() {
 			defer s.wg.Done()
 
-			if err := s.executeMethodQR(encoded, ""); err != nil {
-				slog.Error("session: send", "id", s.id, "method", methodQR, "err", err)
-			}
+			runWithFault(s.cfg().Faults.Send, qrs[0], func() {
+				started := time.Now()
+				club, err := s.executeMethodQR(encoded, "")
+				recordMethodHealth(methodQR, err)
+
+				for _, fg := range qrs {
+					traceSend(s, fg, methodQR, club, started, err)
+				}
+
+				if err != nil {
+					s.logger().Error("session: send", "method", methodNames[methodQR], "club", club.Name, "err", err)
+					return
+				}
+
+				metricDatagramsSent.add(float64(len(encoded)), s.tunnel.name, methodNames[methodQR], club.Name)
+			})
 		}()
 	}
 
 	return nil
 }
 
-func (s *session) executeMethodMessage(encoded string) error {
-	club := randElem(s.cfg.Clubs)
-	user := randElem(s.cfg.Users)
+func (s *session) executeMethodMessage(encoded string) (configClub, error) {
+	club := s.randClub()
+	user := s.randUser()
 	p := messagesSendParams{
 		message: encoded,
 	}
-	_, err := messagesSend(s.cfg.API, club, user, p)
+	_, err := messagesSend(s.cfg().API, club, user, p)
 
-	return err
+	return club, err
 }
 
-func (s *session) executeMethodPost(encoded string) error {
-	club := randElem(s.cfg.Clubs)
+func (s *session) executeMethodPost(encoded string) (configClub, error) {
+	club := s.randClub()
 	p := wallPostParams{
 		message: encoded,
 	}
-	resp, err := wallPost(s.cfg.API, club, p)
+	resp, err := wallPost(s.cfg().API, club, p)
 
 	if err != nil {
-		return err
+		return club, err
 	}
 
 	s.mu.Lock()
 	s.posts[club] = resp
 	s.mu.Unlock()
 
-	return nil
+	return club, nil
 }
 
-func (s *session) executeMethodPostComment(encoded string) error {
+func (s *session) executeMethodPostComment(encoded string) (configClub, error) {
 	s.mu.Lock()
 
 	if len(s.posts) == 0 {
 		s.mu.Unlock()
-		return errors.New("no posts created")
+		return configClub{}, errors.New("no posts created")
 	}
 
 	clubs := []configClub{}
@@ -626,6 +855,10 @@ func (s *session) executeMethodPostComment(encoded string) error {
 		clubs = append(clubs, key)
 	}
 
+	if enabled := enabledClubs(clubs); len(enabled) > 0 {
+		clubs = enabled
+	}
+
 	club := randElem(clubs)
 	post := s.posts[club]
 
@@ -635,23 +868,24 @@ func (s *session) executeMethodPostComment(encoded string) error {
 		postID:  post.PostID,
 		message: encoded,
 	}
-	_, err := wallCreateComment(s.cfg.API, club, p)
+	_, err := wallCreateComment(s.cfg().API, club, p)
 
-	return err
+	return club, err
 }
 
-func (s *session) executeMethodDoc(encoded string) error {
-	club := randElem(s.cfg.Clubs)
+func (s *session) executeMethodDoc(encoded string) (configClub, error) {
+	settings := s.tunnel.loadMethods()
+	club := s.randClub()
 	uploadP := docsUploadParams{
 		data: []byte(encoded),
 	}
-	resp, err := docsUploadAndSave(s.cfg.API, club, uploadP)
+	resp, err := docsUploadAndSave(s.cfg().API, club, uploadP)
 
 	if err != nil {
-		return err
+		return club, err
 	}
 
-	zero := encodeDatagram(newDatagram(0, 0, 0, nil), datagramEncodingASCII)
+	zero := encodeDatagram(newDatagram(s.tunnel.device, 0, 0, 0, nil), datagramEncodingASCII)
 	arg := "caption=" + url.QueryEscape(zero)
 	uri := resp.Doc.URL
 
@@ -664,31 +898,31 @@ func (s *session) executeMethodDoc(encoded string) error {
 	msg := strings.ReplaceAll(uri, ".", ". ")
 	methods := []int{methodMessage, methodPost, methodStorage, methodStorage}
 
-	if enabled := methodsEnabled[methodDescription]; enabled {
+	if enabled := settings.enabled[methodDescription]; enabled {
 		methods = append(methods, methodDescription)
 	}
 
-	if enabled := methodsEnabled[methodWebsite]; enabled {
+	if enabled := settings.enabled[methodWebsite]; enabled {
 		methods = append(methods, methodWebsite)
 	}
 
-	if enabled := methodsEnabled[methodCaption]; enabled {
+	if enabled := settings.enabled[methodCaption]; enabled {
 		methods = append(methods, methodCaption)
 	}
 
-	if enabled := methodsEnabled[methodVideoComment]; enabled {
+	if enabled := settings.enabled[methodVideoComment]; enabled {
 		methods = append(methods, methodVideoComment)
 	}
 
-	if enabled := methodsEnabled[methodPhotoComment]; enabled {
+	if enabled := settings.enabled[methodPhotoComment]; enabled {
 		methods = append(methods, methodPhotoComment)
 	}
 
-	if enabled := methodsEnabled[methodMarketComment]; enabled {
+	if enabled := settings.enabled[methodMarketComment]; enabled {
 		methods = append(methods, methodMarketComment)
 	}
 
-	if enabled := methodsEnabled[methodTopic]; enabled {
+	if enabled := settings.enabled[methodTopic]; enabled {
 		methods = append(methods, methodTopic)
 	}
 
@@ -708,62 +942,62 @@ func (s *session) executeMethodDoc(encoded string) error {
 
 	switch method {
 	case methodMessage:
-		err = s.executeMethodMessage(msg)
+		_, err = s.executeMethodMessage(msg)
 	case methodPost:
-		err = s.executeMethodPost(msg)
+		_, err = s.executeMethodPost(msg)
 	case methodPostComment:
-		err = s.executeMethodPostComment(msg)
+		_, err = s.executeMethodPostComment(msg)
 	case methodCaption:
-		err = s.executeMethodCaption(msg)
+		_, err = s.executeMethodCaption(msg)
 	case methodStorage:
-		err = s.executeMethodStorage(msg)
+		_, err = s.executeMethodStorage(msg)
 	case methodDescription:
-		err = s.executeMethodDescription(msg)
+		_, err = s.executeMethodDescription(msg)
 	case methodWebsite:
-		err = s.executeMethodWebsite(msg)
+		_, err = s.executeMethodWebsite(msg)
 	case methodVideoComment:
-		err = s.executeMethodVideoComment(msg)
+		_, err = s.executeMethodVideoComment(msg)
 	case methodPhotoComment:
-		err = s.executeMethodPhotoComment(msg)
+		_, err = s.executeMethodPhotoComment(msg)
 	case methodMarketComment:
-		err = s.executeMethodMarketComment(msg)
+		_, err = s.executeMethodMarketComment(msg)
 	case methodTopic:
-		err = s.executeMethodTopic(msg)
+		_, err = s.executeMethodTopic(msg)
 	case methodTopicComment:
-		err = s.executeMethodTopicComment(msg)
+		_, err = s.executeMethodTopicComment(msg)
 	default:
 		err = fmt.Errorf("unknown method: %v", method)
 	}
 
-	return err
+	return club, err
 }
 
-func (s *session) executeMethodQR(encoded []string, caption string) error {
+func (s *session) executeMethodQR(encoded []string, caption string) (configClub, error) {
 	qrs := make([][]byte, len(encoded))
 
 	for i, enc := range encoded {
-		qr, err := encodeQR(s.cfg.QR, enc)
+		qr, err := encodeQR(s.cfg().QR, enc)
 
 		if err != nil {
-			return fmt.Errorf("encode: %v", err)
+			return configClub{}, fmt.Errorf("encode: %v", err)
 		}
 
 		qrs[i] = qr
 	}
 
-	qr, err := mergeQR(s.cfg.QR, qrs)
+	qr, err := mergeQR(s.cfg().QR, qrs)
 
 	if err != nil {
-		return fmt.Errorf("merge: %v", err)
+		return configClub{}, fmt.Errorf("merge: %v", err)
 	}
 
 	if len(caption) == 0 {
-		zero := encodeDatagram(newDatagram(0, 0, 0, nil), datagramEncodingRU)
+		zero := encodeDatagram(newDatagram(s.tunnel.device, 0, 0, 0, nil), datagramEncodingRU)
 		caption = zero
 	}
 
-	club := randElem(s.cfg.Clubs)
-	user := randElem(s.cfg.Users)
+	club := s.randClub()
+	user := s.randUser()
 	p := photosUploadAndSaveParams{
 		photosUploadParams: photosUploadParams{
 			data: qr,
@@ -773,110 +1007,110 @@ func (s *session) executeMethodQR(encoded []string, caption string) error {
 		},
 	}
 
-	if _, err := photosUploadAndSave(s.cfg.API, club, user, p); err != nil {
-		return fmt.Errorf("upload: %v", err)
+	if _, err := photosUploadAndSave(s.cfg().API, club, user, p); err != nil {
+		return configClub{}, fmt.Errorf("upload: %v", err)
 	}
 
-	return nil
+	return club, nil
 }
 
-func (s *session) executeMethodCaption(encoded string) error {
-	zero := encodeDatagram(newDatagram(0, 0, 0, nil), datagramEncodingASCII)
+func (s *session) executeMethodCaption(encoded string) (configClub, error) {
+	zero := encodeDatagram(newDatagram(s.tunnel.device, 0, 0, 0, nil), datagramEncodingASCII)
 
 	return s.executeMethodQR([]string{zero}, encoded)
 }
 
-func (s *session) executeMethodStorage(encoded string) error {
-	club := randElem(s.cfg.Clubs)
+func (s *session) executeMethodStorage(encoded string) (configClub, error) {
+	club := s.randClub()
 	p := storageSetParams{
-		key:   createStorageSetKey(),
+		key:   s.tunnel.createStorageSetKey(),
 		value: encoded,
 	}
-	err := storageSet(s.cfg.API, club, p)
+	err := storageSet(s.cfg().API, club, p)
 
-	return err
+	return club, err
 }
 
-func (s *session) executeMethodDescription(encoded string) error {
-	club := randElem(s.cfg.Clubs)
+func (s *session) executeMethodDescription(encoded string) (configClub, error) {
+	club := s.randClub()
 	p := groupsEditParams{
 		description: encoded,
 	}
-	err := groupsEdit(s.cfg.API, club, p)
+	err := groupsEdit(s.cfg().API, club, p)
 
-	return err
+	return club, err
 }
 
-func (s *session) executeMethodWebsite(encoded string) error {
-	club := randElem(s.cfg.Clubs)
+func (s *session) executeMethodWebsite(encoded string) (configClub, error) {
+	club := s.randClub()
 	p := groupsEditParams{
 		website: encoded,
 	}
-	err := groupsEdit(s.cfg.API, club, p)
+	err := groupsEdit(s.cfg().API, club, p)
 
-	return err
+	return club, err
 }
 
-func (s *session) executeMethodVideoComment(encoded string) error {
-	club := randElem(s.cfg.Clubs)
-	user := randElem(s.cfg.Users)
+func (s *session) executeMethodVideoComment(encoded string) (configClub, error) {
+	club := s.randClub()
+	user := s.randUser()
 	p := videoCreateCommentParams{
 		message: encoded,
 	}
-	err := videoCreateComment(s.cfg.API, club, user, p)
+	err := videoCreateComment(s.cfg().API, club, user, p)
 
-	return err
+	return club, err
 }
 
-func (s *session) executeMethodPhotoComment(encoded string) error {
-	club := randElem(s.cfg.Clubs)
-	user := randElem(s.cfg.Users)
+func (s *session) executeMethodPhotoComment(encoded string) (configClub, error) {
+	club := s.randClub()
+	user := s.randUser()
 	p := photosCreateCommentParams{
 		message: encoded,
 	}
-	err := photosCreateComment(s.cfg.API, club, user, p)
+	err := photosCreateComment(s.cfg().API, club, user, p)
 
-	return err
+	return club, err
 }
 
-func (s *session) executeMethodMarketComment(encoded string) error {
-	club := randElem(s.cfg.Clubs)
-	user := randElem(s.cfg.Users)
+func (s *session) executeMethodMarketComment(encoded string) (configClub, error) {
+	club := s.randClub()
+	user := s.randUser()
 	p := marketCreateCommentParams{
 		message: encoded,
 	}
-	err := marketCreateComment(s.cfg.API, club, user, p)
+	err := marketCreateComment(s.cfg().API, club, user, p)
 
-	return err
+	return club, err
 }
 
-func (s *session) executeMethodTopic(encoded string) error {
-	club := randElem(s.cfg.Clubs)
-	user := randElem(s.cfg.Users)
-	zero := encodeDatagram(newDatagram(0, 0, 0, nil), datagramEncodingRU)
+func (s *session) executeMethodTopic(encoded string) (configClub, error) {
+	club := s.randClub()
+	user := s.randUser()
+	zero := encodeDatagram(newDatagram(s.tunnel.device, 0, 0, 0, nil), datagramEncodingRU)
 	p := boardAddTopicParams{
 		title: zero,
 		text:  encoded,
 	}
-	resp, err := boardAddTopic(s.cfg.API, club, user, p)
+	resp, err := boardAddTopic(s.cfg().API, club, user, p)
 
 	if err != nil {
-		return err
+		return club, err
 	}
 
 	s.mu.Lock()
 	s.topics[club] = resp
 	s.mu.Unlock()
 
-	return nil
+	return club, nil
 }
 
-func (s *session) executeMethodTopicComment(encoded string) error {
+func (s *session) executeMethodTopicComment(encoded string) (configClub, error) {
 	s.mu.Lock()
 
 	if len(s.topics) == 0 {
 		s.mu.Unlock()
-		return errors.New("no topics created")
+		return configClub{}, errors.New("no topics created")
 	}
 
 	clubs := []configClub{}
@@ -885,19 +1119,23 @@ func (s *session) executeMethodTopicComment(encoded string) error {
 		clubs = append(clubs, key)
 	}
 
+	if enabled := enabledClubs(clubs); len(enabled) > 0 {
+		clubs = enabled
+	}
+
 	club := randElem(clubs)
 	topic := s.topics[club]
 
 	s.mu.Unlock()
 
-	user := randElem(s.cfg.Users)
+	user := s.randUser()
 	p := boardCreateCommentParams{
 		topicID: topic.ID,
 		message: encoded,
 	}
-	err := boardCreateComment(s.cfg.API, club, user, p)
+	err := boardCreateComment(s.cfg().API, club, user, p)
 
-	return err
+	return club, err
 }
 
 func clearSession(ctx context.Context) error {
@@ -912,19 +1150,9 @@ func clearSession(ctx context.Context) error {
 			case <-ctx.Done():
 				return
 			case <-time.After(10 * time.Second):
-				sessionsMu.Lock()
-
-				for id, ses := range sessions {
-					if ses.isInactive() {
-						slog.Error("session: timeout", "id", id)
-
-						go func(ses *session) {
-							ses.close()
-						}(ses)
-					}
+				for _, t := range tunnels {
+					t.closeInactiveSessions()
 				}
-
-				sessionsMu.Unlock()
 			}
 		}
 	}()
@@ -938,15 +1166,9 @@ func clearSession(ctx context.Context) error {
 			case <-ctx.Done():
 				return
 			case <-time.After(5 * time.Minute):
-				sessionsMu.Lock()
-
-				for id, ses := range sessions {
-					if ses.isClosed() {
-						delete(sessions, id)
-					}
+				for _, t := range tunnels {
+					t.deleteClosedSessions()
 				}
-
-				sessionsMu.Unlock()
 			}
 		}
 	}()
@@ -956,6 +1178,63 @@ func clearSession(ctx context.Context) error {
 	return nil
 }
 
+func (t *tunnel) closeInactiveSessions() int {
+	t.sessionsMu.Lock()
+	defer t.sessionsMu.Unlock()
+
+	n := 0
+
+	for _, ses := range t.sessions {
+		if ses.isInactive() {
+			ses.logger().Error("session: timeout")
+
+			go func(ses *session) {
+				ses.close()
+			}(ses)
+
+			n++
+		}
+	}
+
+	return n
+}
+
+func (t *tunnel) deleteClosedSessions() int {
+	t.sessionsMu.Lock()
+	defer t.sessionsMu.Unlock()
+
+	n := 0
+
+	for id, ses := range t.sessions {
+		if ses.isClosed() {
+			delete(t.sessions, id)
+			n++
+		}
+	}
+
+	return n
+}
+
+func (s *session) randClub() configClub {
+	clubs := enabledClubs(s.cfg().Clubs)
+
+	if len(clubs) == 0 {
+		clubs = s.cfg().Clubs
+	}
+
+	return randElem(clubs)
+}
+
+func (s *session) randUser() configUser {
+	users := enabledUsers(s.cfg().Users)
+
+	if len(users) == 0 {
+		users = s.cfg().Users
+	}
+
+	return randElem(users)
+}
+
 func randElem[T any](elems []T) T {
 	if len(elems) == 0 {
 		return *new(T)
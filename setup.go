@@ -0,0 +1,368 @@
+package main
+
+import (
+	"bufio"
+	_ "embed"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+)
+
+//go:embed stub.jpg
+var stubJPG []byte
+
+//go:embed stub.mp4
+var stubMP4 []byte
+
+type setupPrompt struct {
+	in  *bufio.Reader
+	out io.Writer
+}
+
+func (p setupPrompt) ask(question string, fallback string) (string, error) {
+	if len(fallback) > 0 {
+		fmt.Fprintf(p.out, "%v [%v]: ", question, fallback)
+	} else {
+		fmt.Fprintf(p.out, "%v: ", question)
+	}
+
+	line, err := p.in.ReadString('\n')
+
+	if err != nil && !(errors.Is(err, io.EOF) && len(line) > 0) {
+		return "", err
+	}
+
+	line = strings.TrimSpace(line)
+
+	if len(line) == 0 {
+		return fallback, nil
+	}
+
+	return line, nil
+}
+
+func (p setupPrompt) askRequired(question string) (string, error) {
+	for {
+		answer, err := p.ask(question, "")
+
+		if err != nil {
+			return "", err
+		}
+
+		if len(answer) > 0 {
+			return answer, nil
+		}
+	}
+}
+
+func (p setupPrompt) confirm(question string) (bool, error) {
+	answer, err := p.ask(question+" (y/n)", "n")
+
+	if err != nil {
+		return false, err
+	}
+
+	return strings.EqualFold(answer, "y") || strings.EqualFold(answer, "yes"), nil
+}
+
+func runSetup(name string, in io.Reader, out io.Writer) error {
+	p := setupPrompt{
+		in:  bufio.NewReader(in),
+		out: out,
+	}
+	cfg, err := loadEditableConfig(name, out)
+
+	if err != nil {
+		return err
+	}
+
+	if len(cfg.Session.Secret) == 0 {
+		secret, err := setupSecret(p)
+
+		if err != nil {
+			return err
+		}
+
+		cfg.Session.Secret = secret
+	}
+
+	key, err := secretToKey(cfg.Session.Secret)
+
+	if err != nil {
+		return fmt.Errorf("session secret: %v", err)
+	}
+
+	cfg.Session.SecretKey = key
+
+	user, err := setupUser(p, cfg)
+
+	if err != nil {
+		return err
+	}
+
+	cfg.Users = append(cfg.Users, user)
+
+	for {
+		club, err := setupClub(p, cfg, user)
+
+		if err != nil {
+			return err
+		}
+
+		cfg.Clubs = append(cfg.Clubs, club)
+
+		more, err := p.confirm("Add another club?")
+
+		if err != nil {
+			return err
+		}
+
+		if !more {
+			break
+		}
+	}
+
+	if err := validateConfig(cfg); err != nil {
+		return exitError{exitCodeConfig, fmt.Errorf("validate config: %v", err)}
+	}
+
+	if err := writeConfig(name, cfg); err != nil {
+		return err
+	}
+
+	fmt.Fprintf(out, "Config is written to %v\n", name)
+	fmt.Fprintln(out, "Send any message to each club from your account, then start vk-proxy")
+
+	return nil
+}
+
+// Config with env references or secrets file can't be written back
+// without losing them, so only plain configs are edited.
+func loadEditableConfig(name string, out io.Writer) (config, error) {
+	cfg := defaultConfig()
+	data, err := os.ReadFile(name)
+
+	if err != nil || len(data) == 0 {
+		client, err := newAPIClient(cfg.API)
+
+		if err != nil {
+			return config{}, fmt.Errorf("api: %v", err)
+		}
+
+		cfg.API.Client = client
+
+		return cfg, nil
+	}
+
+	cfg, err = parseConfig(name)
+
+	if err != nil {
+		return config{}, exitError{exitCodeConfig, fmt.Errorf("parse config: %v", err)}
+	}
+
+	if envPattern.Match(data) || len(cfg.Secrets) > 0 {
+		return config{}, errors.New("config uses env references or secrets file, edit it manually")
+	}
+
+	if len(cfg.Tunnels) > 0 {
+		return config{}, errors.New("config uses tunnels, edit it manually")
+	}
+
+	fmt.Fprintf(out, "%v already exists, new clubs and users will be added to it\n", name)
+
+	return cfg, nil
+}
+
+func writeConfig(name string, cfg config) error {
+	data, err := json.MarshalIndent(cfg, "", "    ")
+
+	if err != nil {
+		return err
+	}
+
+	return os.WriteFile(name, append(data, '\n'), 0600)
+}
+
+// Pasted secret is checked before any club is provisioned.
+func setupSecret(p setupPrompt) (string, error) {
+	for {
+		secret, err := p.ask("Session secret from the other device, empty to generate", "")
+
+		if err != nil {
+			return "", err
+		}
+
+		if len(secret) == 0 {
+			if secret, err = generateSecret(); err != nil {
+				return "", fmt.Errorf("generate secret: %v", err)
+			}
+
+			fmt.Fprintf(p.out, "Generated secret, use it on the other device: %v\n", secret)
+
+			return secret, nil
+		}
+
+		if _, err := secretToKey(secret); err != nil {
+			fmt.Fprintf(p.out, "Invalid secret: %v\n", err)
+			continue
+		}
+
+		return secret, nil
+	}
+}
+
+func setupUser(p setupPrompt, cfg config) (configUser, error) {
+	user := configUser{}
+	var err error
+
+	if user.ID, err = p.askRequired("User ID"); err != nil {
+		return configUser{}, err
+	}
+
+	if user.AccessToken, err = p.askRequired("User access token"); err != nil {
+		return configUser{}, err
+	}
+
+	if user.Name, err = p.ask("User name", "user"+strconv.Itoa(len(cfg.Users)+1)); err != nil {
+		return configUser{}, err
+	}
+
+	if err := validateUser(cfg.API, user); err != nil {
+		return configUser{}, fmt.Errorf("validate user: %v", err)
+	}
+
+	return user, nil
+}
+
+func setupClub(p setupPrompt, cfg config, user configUser) (configClub, error) {
+	club := configClub{}
+	var err error
+
+	if club.ID, err = p.askRequired("Club ID"); err != nil {
+		return configClub{}, err
+	}
+
+	if club.AccessToken, err = p.askRequired("Club access token"); err != nil {
+		return configClub{}, err
+	}
+
+	if club.Name, err = p.ask("Club name", "club"+club.ID); err != nil {
+		return configClub{}, err
+	}
+
+	if err := provisionClub(cfg.API, &club, user, p.out); err != nil {
+		return configClub{}, fmt.Errorf("club %v: %v", club.Name, err)
+	}
+
+	return club, nil
+}
+
+func provisionClub(cfg configAPI, club *configClub, user configUser, out io.Writer) error {
+	if err := validateClub(cfg, *club); err != nil {
+		return fmt.Errorf("validate club: %v", err)
+	}
+
+	edit := groupsEditParams{
+		private: true,
+		docs:    true,
+		market:  true,
+	}
+
+	if err := groupsEdit(cfg, *club, edit); err != nil {
+		return fmt.Errorf("enable sections: %v", err)
+	}
+
+	fmt.Fprintf(out, "%v: club is private, files and market are enabled\n", club.Name)
+
+	settings := groupsSetLongPollSettingsParams{
+		events: longPollEvents,
+	}
+
+	if err := groupsSetLongPollSettings(cfg, *club, settings); err != nil {
+		return fmt.Errorf("enable long poll: %v", err)
+	}
+
+	if err := validateLongPoll(cfg, *club); err != nil {
+		return fmt.Errorf("validate long poll: %v", err)
+	}
+
+	fmt.Fprintf(out, "%v: long poll is enabled\n", club.Name)
+
+	album, err := photosCreateAlbum(cfg, *club, user, photosCreateAlbumParams{title: "vk-proxy"})
+
+	if err != nil {
+		return fmt.Errorf("create album: %v", err)
+	}
+
+	club.AlbumID = strconv.Itoa(album.ID)
+
+	photoP := photosUploadAndSaveParams{
+		photosUploadParams: photosUploadParams{
+			data: stubJPG,
+		},
+	}
+	photo, err := photosUploadAndSave(cfg, *club, user, photoP)
+
+	if err != nil {
+		return fmt.Errorf("upload photo: %v", err)
+	}
+
+	club.PhotoID = strconv.Itoa(photo.ID)
+
+	fmt.Fprintf(out, "%v: album %v and photo %v are created\n", club.Name, club.AlbumID, club.PhotoID)
+
+	video, err := videoSave(cfg, *club, user, videoSaveParams{name: "vk-proxy"})
+
+	if err != nil {
+		return fmt.Errorf("save video: %v", err)
+	}
+
+	if err := videoUpload(cfg, videoUploadParams{uploadURL: video.UploadURL, data: stubMP4}); err != nil {
+		return fmt.Errorf("upload video: %v", err)
+	}
+
+	club.VideoID = strconv.Itoa(video.VideoID)
+
+	fmt.Fprintf(out, "%v: video %v is uploaded\n", club.Name, club.VideoID)
+
+	server, err := photosGetMarketUploadServer(cfg, *club, user)
+
+	if err != nil {
+		return fmt.Errorf("market upload server: %v", err)
+	}
+
+	upload, err := photosUploadMarket(cfg, photosUploadMarketParams{uploadURL: server.UploadURL, data: stubJPG})
+
+	if err != nil {
+		return fmt.Errorf("upload market photo: %v", err)
+	}
+
+	marketPhoto, err := photosSaveMarketPhoto(cfg, *club, user, upload)
+
+	if err != nil {
+		return fmt.Errorf("save market photo: %v", err)
+	}
+
+	itemP := marketAddParams{
+		name:        "vk-proxy",
+		description: "vk-proxy",
+		categoryID:  1,
+		price:       1,
+		mainPhotoID: marketPhoto.ID,
+	}
+	item, err := marketAdd(cfg, *club, user, itemP)
+
+	if err != nil {
+		return fmt.Errorf("add market item: %v", err)
+	}
+
+	club.MarketID = strconv.Itoa(item.MarketItemID)
+
+	fmt.Fprintf(out, "%v: market item %v is created\n", club.Name, club.MarketID)
+
+	return nil
+}
@@ -7,9 +7,9 @@ import (
 	"errors"
 	"fmt"
 	"io"
-	"log/slog"
 	"net"
 	"slices"
+	"strconv"
 	"strings"
 	"sync"
 	"time"
@@ -24,12 +24,13 @@ const (
 )
 
 var (
-	errUnacceptable = errors.New("unacceptable")
-	errUnsupported  = errors.New("unsupported")
-	errPartialRead  = errors.New("partial read")
+	errUnacceptable  = errors.New("unacceptable")
+	errUnsupported   = errors.New("unsupported")
+	errPartialRead   = errors.New("partial read")
+	errConnectFailed = errors.New("connect failed")
 )
 
-func listenSocks(ctx context.Context, cfg config) error {
+func listenSocks(ctx context.Context, t *tunnel, cfg config) error {
 	addr := address{cfg.Socks.Host, cfg.Socks.Port}.String()
 	ln, err := net.Listen("tcp", addr)
 
@@ -42,42 +43,60 @@ func listenSocks(ctx context.Context, cfg config) error {
 		ln.Close()
 	}()
 
-	slog.Info("socks: listening", "addr", addr)
+	t.logger().Info("socks: listening", "addr", addr)
 
 	for {
 		conn, err := ln.Accept()
 
 		if err != nil {
-			slog.Error("socks: accept", "err", err)
+			t.logger().Error("socks: accept", "err", err)
 			continue
 		}
 
-		ses, err := openSession(nextSessionID(), cfg)
+		ses, err := openSession(t, t.nextSessionID())
 
 		if err != nil {
-			slog.Error("socks: session", "err", err)
+			t.logger().Error("socks: session", "err", err)
 			conn.Close()
 			continue
 		}
 
 		ses.setPeer(conn)
-		setSession(ses.id, ses)
+		t.setSession(ses.id, ses)
 
 		go acceptSocks(cfg, ses, stageHandshake)
 	}
 }
 
 func acceptSocks(cfg config, ses *session, stage int) {
-	peer := ses.peer.RemoteAddr().String()
-
-	defer slog.Info("socks: closed", "peer", peer, "ses", ses)
+	defer func() {
+		ses.logger().Info("socks: closed")
+	}()
 	defer ses.close()
 
-	slog.Debug("socks: accept", "peer", peer, "ses", ses)
+	ses.logger().Debug("socks: accept")
 
 	if err := handleSocks(cfg, ses, stage); err != nil {
-		slog.Error("socks: handle", "peer", peer, "ses", ses, "err", err)
+		ses.logger().Error("socks: handle", "err", err)
+	}
+}
+
+func acceptTarget(cfg config, ses *session, addr address, cmd dgCmd) {
+	if err := handleStageConnectSession(cfg, ses, addr, cmd); err != nil {
+		ses.logger().Error("socks: connect", "err", err)
+		ses.close()
+		return
 	}
+
+	if _, err := handleStageConnectResult(cfg, ses, nil); err != nil {
+		ses.logger().Error("socks: connect", "err", err)
+		ses.close()
+		return
+	}
+
+	ses.logger().Info("socks: forwarding")
+
+	acceptSocks(cfg, ses, stageForward)
 }
 
 type opBuffer struct {
@@ -123,7 +142,6 @@ func handleSocks(cfg config, ses *session, stage int) error {
 }
 
 func readSocks(cfg config, ses *session, stage int, fwdBuf *opBuffer) error {
-	peer := ses.peer.RemoteAddr().String()
 	temp := make([]byte, 4*1024)
 
 	for {
@@ -136,11 +154,8 @@ func readSocks(cfg config, ses *session, stage int, fwdBuf *opBuffer) error {
 		if readN > 0 {
 			in := temp[:readN]
 
-			slog.Debug("socks: read", "peer", peer, "len", len(in))
-
-			if cfg.Log.Payload {
-				slog.Debug("socks: payload", "peer", peer, "in", bytesToHex(in))
-			}
+			ses.logger().Debug("socks: read", "len", len(in))
+			logPayload("socks: payload", ses, "in", in)
 
 			if stage == stageHandshake && in[0] == 0x04 {
 				stage = stageConnectV4
@@ -170,10 +185,19 @@ func readSocks(cfg config, ses *session, stage int, fwdBuf *opBuffer) error {
 
 			switch stage {
 			case stageConnectSession:
-				err = handleStageConnectSession(cfg, ses, addr)
+				if action, dial := routeAddress(cfg.Routing, addr); action == ruleActionDirect {
+					ses.logger().Info("socks: direct", "addr", addr)
+					return handleStageDirect(cfg, ses, addr, dial, out)
+				}
+
+				err = handleStageConnectSession(cfg, ses, addr, commandConnect)
+
+				if err == nil {
+					out, err = handleStageConnectResult(cfg, ses, out)
+				}
 
 				if err == nil {
-					slog.Info("socks: forwarding", "peer", peer, "ses", ses, "addr", addr)
+					ses.logger().Info("socks: forwarding")
 					stage = stageForward
 				}
 			case stageForward:
@@ -227,7 +251,7 @@ func forwardsSocks(cfg config, ses *session, buf *opBuffer) error {
 		buf.mu.Unlock()
 
 		if len(in) > 0 {
-			slog.Debug("socks: forward", "ses", ses, "len", len(in))
+			ses.logger().Debug("socks: forward", "len", len(in))
 
 			err := handleStageForward(ses, in, cfg.Socks.ForwardSize)
 
@@ -243,13 +267,8 @@ func forwardsSocks(cfg config, ses *session, buf *opBuffer) error {
 }
 
 func writeSocks(cfg config, ses *session, out []byte) error {
-	peer := ses.peer.RemoteAddr().String()
-
-	slog.Debug("socks: write", "peer", peer, "len", len(out))
-
-	if cfg.Log.Payload {
-		slog.Debug("socks: payload", "peer", peer, "out", bytesToHex(out))
-	}
+	ses.logger().Debug("socks: write", "len", len(out))
+	logPayload("socks: payload", ses, "out", out)
 
 	timeout := 10 * time.Second
 	deadline := time.Now().Add(timeout)
@@ -398,16 +417,19 @@ func handleStageConnectV5(in []byte) (address, []byte, error) {
 	return dst, out, nil
 }
 
-func handleStageConnectSession(cfg config, ses *session, addr address) error {
+func handleStageConnectSession(cfg config, ses *session, addr address, cmd dgCmd) error {
+	ses.setTarget(addr)
+
 	pld := payloadConnect(addr)
 	encoded := pld.encode()
-	encrypted, err := encrypt(encoded, cfg.Session.SecretKey)
+	key, encrypted, err := ses.tunnel.loadKeys().seal(encoded)
 
 	if err != nil {
 		return err
 	}
 
-	dg := newDatagram(0, 0, commandConnect, encrypted)
+	dg := newDatagram(ses.tunnel.device, 0, 0, cmd, encrypted)
+	dg.key = key
 
 	if err := ses.sendDatagram(dg); err != nil {
 		return err
@@ -416,11 +438,102 @@ func handleStageConnectSession(cfg config, ses *session, addr address) error {
 	return nil
 }
 
+func handleStageConnectResult(cfg config, ses *session, out []byte) ([]byte, error) {
+	timeout := cfg.Socks.ConnectTimeout()
+
+	if timeout == 0 {
+		return out, nil
+	}
+
+	result := connectResultFailure
+	pld, err := ses.waitConnectResult(timeout)
+
+	switch {
+	case err == nil:
+		result = pld.result
+	case errors.Is(err, errConnectTimeout):
+		result = connectResultTTLExpired
+	}
+
+	setConnectReply(out, result)
+
+	if err == nil && result != connectResultSucceeded {
+		err = fmt.Errorf("%w: %v", errConnectFailed, result)
+	}
+
+	return out, err
+}
+
+func setConnectReply(out []byte, result byte) {
+	if len(out) < 2 {
+		return
+	}
+
+	if out[0] == 0x05 {
+		out[1] = result
+	} else if result != connectResultSucceeded {
+		out[1] = 0x5b
+	}
+}
+
+func handleStageDirect(cfg config, ses *session, addr address, dial address, out []byte) error {
+	ses.setDirect()
+	ses.setTarget(addr)
+
+	timeout := 10 * time.Second
+	conn, err := net.DialTimeout("tcp", dial.String(), timeout)
+
+	if err != nil {
+		setConnectReply(out, errorToConnectResult(err))
+
+		if writeErr := writeSocks(cfg, ses, out); writeErr != nil {
+			return errors.Join(err, writeErr)
+		}
+
+		return err
+	}
+
+	defer conn.Close()
+
+	if err := writeSocks(cfg, ses, out); err != nil {
+		return err
+	}
+
+	if err := ses.peer.SetDeadline(time.Time{}); err != nil {
+		return err
+	}
+
+	errs := make(chan error, 2)
+
+	go func() {
+		_, err := io.Copy(conn, ses.peer)
+		errs <- err
+	}()
+
+	go func() {
+		_, err := io.Copy(ses.peer, conn)
+		errs <- err
+	}()
+
+	err = <-errs
+
+	conn.Close()
+	ses.peer.Close()
+
+	<-errs
+
+	if errors.Is(err, net.ErrClosed) {
+		return nil
+	}
+
+	return err
+}
+
 func handleStageForward(ses *session, in []byte, chunkSize int) error {
 	chunks := bytesToChunks(in, chunkSize, 0)
 
 	for _, chunk := range chunks {
-		dg := newDatagram(0, 0, commandForward, chunk)
+		dg := newDatagram(ses.tunnel.device, 0, 0, commandForward, chunk)
 
 		if err := ses.sendDatagram(dg); err != nil {
 			return err
@@ -443,6 +556,22 @@ func (a address) String() string {
 	return fmt.Sprintf("%v:%v", a.host, a.port)
 }
 
+func parseAddress(s string) (address, error) {
+	host, port, err := net.SplitHostPort(s)
+
+	if err != nil {
+		return address{}, err
+	}
+
+	n, err := strconv.ParseUint(port, 10, 16)
+
+	if err != nil {
+		return address{}, fmt.Errorf("invalid port: %v", port)
+	}
+
+	return address{host, uint16(n)}, nil
+}
+
 func bytesToHex(b []byte) string {
 	return fmt.Sprintf("% x", b)
 }
@@ -0,0 +1,224 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strings"
+	"text/tabwriter"
+	"time"
+)
+
+type statusSnapshot struct {
+	stats    adminStats
+	sessions []adminSession
+	methods  []adminMethod
+	clubs    []adminHealth
+	users    []adminHealth
+	at       time.Time
+}
+
+func runStatus(ctx context.Context, cfg config) error {
+	if cfg.Admin.Port == 0 {
+		return errors.New("admin.port is not set")
+	}
+
+	base := "http://" + address{cfg.Admin.Host, cfg.Admin.Port}.String()
+	client := &http.Client{
+		Timeout: 2 * time.Second,
+	}
+
+	var last statusSnapshot
+
+	for {
+		snap, err := fetchStatus(client, base, cfg.Admin.Token)
+		out := &bytes.Buffer{}
+
+		if err != nil {
+			fmt.Fprintf(out, "vk-proxy status  %v  %v\n\n", base, time.Now().Format(time.TimeOnly))
+			fmt.Fprintf(out, "error: %v\n", err)
+		} else {
+			renderStatus(out, base, snap, last)
+			last = snap
+		}
+
+		fmt.Fprint(os.Stdout, "\033[H\033[2J")
+		os.Stdout.Write(out.Bytes())
+
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-time.After(time.Second):
+		}
+	}
+}
+
+func fetchStatus(client *http.Client, base string, token string) (statusSnapshot, error) {
+	snap := statusSnapshot{
+		at: time.Now(),
+	}
+	targets := map[string]any{
+		"/stats":    &snap.stats,
+		"/sessions": &snap.sessions,
+		"/methods":  &snap.methods,
+		"/clubs":    &snap.clubs,
+		"/users":    &snap.users,
+	}
+
+	for path, v := range targets {
+		if err := fetchStatusJSON(client, token, base+path, v); err != nil {
+			return statusSnapshot{}, err
+		}
+	}
+
+	return snap, nil
+}
+
+func fetchStatusJSON(client *http.Client, token string, uri string, v any) error {
+	req, err := http.NewRequest(http.MethodGet, uri, nil)
+
+	if err != nil {
+		return err
+	}
+
+	if len(token) > 0 {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+
+	resp, err := client.Do(req)
+
+	if err != nil {
+		return err
+	}
+
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("%v: HTTP %v", uri, resp.StatusCode)
+	}
+
+	data, err := io.ReadAll(resp.Body)
+
+	if err != nil {
+		return err
+	}
+
+	return json.Unmarshal(data, v)
+}
+
+func renderStatus(out io.Writer, base string, snap statusSnapshot, last statusSnapshot) {
+	fmt.Fprintf(out, "vk-proxy status  %v  %v  uptime %v\n\n", base, snap.at.Format(time.TimeOnly), time.Duration(snap.stats.Uptime)*time.Second)
+
+	var inRate, outRate float64
+
+	if !last.at.IsZero() {
+		elapsed := snap.at.Sub(last.at).Seconds()
+		inRate = float64(snap.stats.InBytes-last.stats.InBytes) / elapsed
+		outRate = float64(snap.stats.OutBytes-last.stats.OutBytes) / elapsed
+	}
+
+	fmt.Fprintf(out, "Throughput  in %v/s  out %v/s\n", formatBytes(inRate), formatBytes(outRate))
+	fmt.Fprintf(out, "Total       in %v  out %v\n", formatBytes(float64(snap.stats.InBytes)), formatBytes(float64(snap.stats.OutBytes)))
+	fmt.Fprintf(out, "Sessions    %v\n\n", snap.stats.Sessions)
+
+	tw := tabwriter.NewWriter(out, 0, 0, 2, ' ', 0)
+
+	fmt.Fprintln(tw, "SESSION\tPEER\tTARGET\tAGE\tIDLE\tIN\tOUT\tFRAGMENTS")
+
+	for _, ses := range snap.sessions {
+		id := fmt.Sprint(ses.ID)
+		target := ses.Target
+
+		if len(ses.Tunnel) > 0 {
+			id = ses.Tunnel + "/" + id
+		}
+
+		if ses.Direct {
+			target += " (direct)"
+		}
+
+		fmt.Fprintf(tw, "%v\t%v\t%v\t%vs\t%vs\t%v\t%v\t%v\n", id, ses.Peer, target, ses.Age, ses.Idle, formatBytes(float64(ses.InBytes)), formatBytes(float64(ses.OutBytes)), ses.Fragments)
+	}
+
+	fmt.Fprintln(tw)
+	fmt.Fprintln(tw, "METHOD\tENABLED\tSENT\tERRORS\tSUCCESS\tFLOOD\tLAST ERROR")
+
+	for _, m := range snap.methods {
+		if !m.Enabled && m.Requests == 0 {
+			continue
+		}
+
+		fmt.Fprintf(tw, "%v\t%v\t%v\t%v\t%v\t%v\t%v\n", m.Name, m.Enabled, m.Requests, m.Errors, formatSuccess(m.health), m.FloodControl, formatLastError(m.health))
+	}
+
+	fmt.Fprintln(tw)
+	fmt.Fprintln(tw, "CLUB\tSTATE\tREQUESTS\tERRORS\tSUCCESS\tFLOOD\tLAST ERROR")
+	renderStatusHealth(tw, snap.clubs)
+
+	fmt.Fprintln(tw)
+	fmt.Fprintln(tw, "USER\tSTATE\tREQUESTS\tERRORS\tSUCCESS\tFLOOD\tLAST ERROR")
+	renderStatusHealth(tw, snap.users)
+
+	tw.Flush()
+}
+
+func renderStatusHealth(w io.Writer, list []adminHealth) {
+	for _, h := range list {
+		state := "enabled"
+
+		if h.Disabled {
+			state = "disabled"
+		}
+
+		name := h.Name
+
+		if len(h.Tunnel) > 0 {
+			name = h.Tunnel + "/" + h.Name
+		}
+
+		fmt.Fprintf(w, "%v\t%v\t%v\t%v\t%v\t%v\t%v\n", name, state, h.Requests, h.Errors, formatSuccess(h.health), h.FloodControl, formatLastError(h.health))
+	}
+}
+
+func formatSuccess(h health) string {
+	if h.Requests == 0 {
+		return "-"
+	}
+
+	return fmt.Sprintf("%.1f%%", float64(h.Requests-h.Errors)/float64(h.Requests)*100)
+}
+
+func formatLastError(h health) string {
+	if len(h.LastError) == 0 {
+		return ""
+	}
+
+	msg := []rune(strings.ReplaceAll(h.LastError, "\t", " "))
+
+	if len(msg) > 60 {
+		msg = append(msg[:57], []rune("...")...)
+	}
+
+	return fmt.Sprintf("%v ago: %v", time.Since(h.LastErrorAt).Truncate(time.Second), string(msg))
+}
+
+func formatBytes(n float64) string {
+	units := []string{"B", "KB", "MB", "GB"}
+	i := 0
+
+	for n >= 1024 && i < len(units)-1 {
+		n /= 1024
+		i++
+	}
+
+	if i == 0 {
+		return fmt.Sprintf("%.0f %v", n, units[i])
+	}
+
+	return fmt.Sprintf("%.1f %v", n, units[i])
+}
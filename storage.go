@@ -3,7 +3,6 @@ package main
 import (
 	"context"
 	"fmt"
-	"log/slog"
 	"math/rand"
 	"strings"
 	"sync"
@@ -16,12 +15,14 @@ const (
 	storageNamespaceB
 )
 
-var storageMu = sync.Mutex{}
-var storageNamespace = storageNamespaceUnknown
-var storageNamespaceChangedAt = time.Time{}
-var storageNextKey = 0
+type storageState struct {
+	mu                 sync.Mutex
+	namespace          int
+	namespaceChangedAt time.Time
+	nextKey            int
+}
 
-func listenStorage(ctx context.Context, cfg config, club configClub) error {
+func listenStorage(ctx context.Context, t *tunnel, cfg config, club configClub) error {
 	params := storageGetParams{
 		keys: createStorageGetKeys(),
 	}
@@ -33,14 +34,14 @@ func listenStorage(ctx context.Context, cfg config, club configClub) error {
 
 	var sleep time.Duration
 
-	slog.Info("storage: listening", "club", club.Name)
+	t.logger().Info("storage: listening", "club", club.Name)
 
 	for {
 		select {
 		case <-ctx.Done():
 			return nil
 		case <-time.After(sleep):
-			if !isSessionOpened() {
+			if !t.isSessionOpened() {
 				sleep = time.Millisecond * 500
 				continue
 			}
@@ -48,7 +49,7 @@ func listenStorage(ctx context.Context, cfg config, club configClub) error {
 			current, err := storageGet(cfg.API, club, params)
 
 			if err != nil {
-				slog.Error("storage: listen", "club", club.Name, "err", err)
+				t.logger().Error("storage: listen", "club", club.Name, "err", err)
 				sleep = time.Second * 5
 				continue
 			}
@@ -58,8 +59,8 @@ func listenStorage(ctx context.Context, cfg config, club configClub) error {
 
 			for _, resp := range changed {
 				go func(value string) {
-					if err := handleStorageUpdate(cfg, club, value); err != nil {
-						slog.Error("storage: update", "club", club.Name, "err", err)
+					if err := handleStorageUpdate(t, cfg, club, value); err != nil {
+						t.logger().Error("storage: update", "club", club.Name, "err", err)
 					}
 				}(resp.Value)
 			}
@@ -69,12 +70,12 @@ func listenStorage(ctx context.Context, cfg config, club configClub) error {
 	}
 }
 
-func handleStorageUpdate(cfg config, club configClub, value string) error {
+func handleStorageUpdate(t *tunnel, cfg config, club configClub, value string) error {
 	if len(value) == 0 {
 		return nil
 	}
 
-	decideStorageNamespace(value)
+	t.decideStorageNamespace(value)
 
 	upd := update{
 		Type: "storage_change",
@@ -83,7 +84,7 @@ func handleStorageUpdate(cfg config, club configClub, value string) error {
 		},
 	}
 
-	return handleUpdate(cfg, club, upd)
+	return handleUpdate(t, cfg, club, upd)
 }
 
 func diffStorageValues(oldValues, newValues []storageGetResponse) []storageGetResponse {
@@ -107,11 +108,11 @@ func diffStorageValues(oldValues, newValues []storageGetResponse) []storageGetRe
 	return changed
 }
 
-func decideStorageNamespace(value string) {
-	storageMu.Lock()
-	defer storageMu.Unlock()
+func (t *tunnel) decideStorageNamespace(value string) {
+	t.storage.mu.Lock()
+	defer t.storage.mu.Unlock()
 
-	if time.Since(storageNamespaceChangedAt) < 10*time.Second {
+	if time.Since(t.storage.namespaceChangedAt) < 10*time.Second {
 		return
 	}
 
@@ -121,11 +122,11 @@ func decideStorageNamespace(value string) {
 
 	dg, err := decodeDatagram(value)
 
-	if err != nil || dg.isLoopback() {
+	if err != nil || dg.isLoopback(t.device) {
 		return
 	}
 
-	me := deviceID
+	me := t.device
 	interlocutor := dg.device
 	newNamespace := storageNamespaceUnknown
 
@@ -135,12 +136,12 @@ func decideStorageNamespace(value string) {
 		newNamespace = storageNamespaceB
 	}
 
-	if newNamespace != storageNamespace {
-		slog.Debug("storage: namespace change", "old", storageNamespace, "new", newNamespace)
+	if newNamespace != t.storage.namespace {
+		t.logger().Debug("storage: namespace change", "old", t.storage.namespace, "new", newNamespace)
 	}
 
-	storageNamespace = newNamespace
-	storageNamespaceChangedAt = time.Now()
+	t.storage.namespace = newNamespace
+	t.storage.namespaceChangedAt = time.Now()
 }
 
 func createStorageGetKeys() []string {
@@ -153,23 +154,23 @@ func createStorageGetKeys() []string {
 	return keys
 }
 
-func createStorageSetKey() string {
-	storageMu.Lock()
-	defer storageMu.Unlock()
+func (t *tunnel) createStorageSetKey() string {
+	t.storage.mu.Lock()
+	defer t.storage.mu.Unlock()
 
 	key := 0
 
-	if storageNamespace == storageNamespaceUnknown {
+	if t.storage.namespace == storageNamespaceUnknown {
 		key = rand.Intn(200) + 1
 	} else {
-		if storageNamespace == storageNamespaceA && (storageNextKey < 1 || storageNextKey > 100) {
-			storageNextKey = 1
-		} else if storageNamespace == storageNamespaceB && (storageNextKey < 101 || storageNextKey > 200) {
-			storageNextKey = 101
+		if t.storage.namespace == storageNamespaceA && (t.storage.nextKey < 1 || t.storage.nextKey > 100) {
+			t.storage.nextKey = 1
+		} else if t.storage.namespace == storageNamespaceB && (t.storage.nextKey < 101 || t.storage.nextKey > 200) {
+			t.storage.nextKey = 101
 		}
 
-		key = storageNextKey
-		storageNextKey++
+		key = t.storage.nextKey
+		t.storage.nextKey++
 	}
 
 	return fmt.Sprintf("key-%v", key)
@@ -0,0 +1,310 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"slices"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	traceDirectionSend    = "send"
+	traceDirectionReceive = "recv"
+)
+
+type traceRecord struct {
+	Time      time.Time `json:"time"`
+	Direction string    `json:"dir"`
+	Tunnel    string    `json:"tunnel,omitempty"`
+	Peer      dgDev     `json:"peer,omitempty"`
+	Key       dgKey     `json:"key,omitempty"`
+	Version   dgVer     `json:"ver"`
+	Checksum  dgSum     `json:"sum"`
+	Device    dgDev     `json:"dev"`
+	Session   dgSes     `json:"ses"`
+	Number    dgNum     `json:"num"`
+	Command   dgCmd     `json:"cmd"`
+	Payload   int       `json:"pld"`
+	Method    string    `json:"method,omitempty"`
+	Type      string    `json:"type,omitempty"`
+	Club      string    `json:"club,omitempty"`
+	Duration  int64     `json:"duration,omitempty"`
+	Error     string    `json:"err,omitempty"`
+}
+
+func newTraceRecord(direction string, tunnel string, peer dgDev, dg datagram) traceRecord {
+	return traceRecord{
+		Time:      time.Now(),
+		Direction: direction,
+		Tunnel:    tunnel,
+		Peer:      peer,
+		Key:       dg.key,
+		Version:   dg.version,
+		Checksum:  dg.checksum,
+		Device:    dg.device,
+		Session:   dg.session,
+		Number:    dg.number,
+		Command:   dg.command,
+		Payload:   len(dg.payload),
+	}
+}
+
+func (r traceRecord) datagram() datagram {
+	return datagram{
+		key:      r.Key,
+		version:  r.Version,
+		checksum: r.Checksum,
+		device:   r.Device,
+		session:  r.Session,
+		number:   r.Number,
+		command:  r.Command,
+		payload:  make([]byte, r.Payload),
+	}
+}
+
+// Datagrams received from the interlocutor carry its session ID,
+// which is stored locally with negated sign. Old peers use the same ID.
+func (r traceRecord) localSession() dgSes {
+	if r.Direction == traceDirectionReceive && r.Version >= datagramVersionNegated {
+		return -r.Session
+	}
+
+	return r.Session
+}
+
+// Session IDs are unique only within tunnel and peer.
+type traceKey struct {
+	tunnel  string
+	peer    dgDev
+	session dgSes
+}
+
+func (r traceRecord) key() traceKey {
+	return traceKey{
+		tunnel:  r.Tunnel,
+		peer:    r.Peer,
+		session: r.localSession(),
+	}
+}
+
+type traceWriter struct {
+	mu  sync.Mutex
+	enc *json.Encoder
+}
+
+var traceOut *traceWriter
+
+func configureTrace(cfg configTrace) error {
+	if len(cfg.Output) == 0 {
+		traceOut = nil
+		return nil
+	}
+
+	f, err := os.OpenFile(cfg.Output, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+
+	if err != nil {
+		return err
+	}
+
+	traceOut = &traceWriter{
+		enc: json.NewEncoder(f),
+	}
+
+	return nil
+}
+
+func traceSend(ses *session, dg datagram, method int, club configClub, started time.Time, err error) {
+	t := traceOut
+
+	if t == nil {
+		return
+	}
+
+	r := newTraceRecord(traceDirectionSend, ses.tunnel.name, ses.getDevice(), dg)
+	r.Time = started
+	r.Method = methodNames[method]
+	r.Club = club.Name
+	r.Duration = time.Since(started).Milliseconds()
+
+	if err != nil {
+		r.Error = err.Error()
+	}
+
+	t.write(r)
+}
+
+func traceReceive(tun *tunnel, dg datagram, updType string, club configClub, err error) {
+	t := traceOut
+
+	if t == nil {
+		return
+	}
+
+	r := newTraceRecord(traceDirectionReceive, tun.name, dg.device, dg)
+	r.Type = updType
+	r.Club = club.Name
+
+	if err != nil {
+		r.Error = err.Error()
+	}
+
+	t.write(r)
+}
+
+func (t *traceWriter) write(r traceRecord) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	t.enc.Encode(r)
+}
+
+func replayTrace(name string, out io.Writer) error {
+	f, err := os.Open(name)
+
+	if err != nil {
+		return err
+	}
+
+	defer f.Close()
+
+	timelines := map[traceKey][]traceRecord{}
+	scanner := bufio.NewScanner(f)
+	line := 0
+
+	for scanner.Scan() {
+		line++
+
+		if len(strings.TrimSpace(scanner.Text())) == 0 {
+			continue
+		}
+
+		var r traceRecord
+
+		if err := json.Unmarshal(scanner.Bytes(), &r); err != nil {
+			return fmt.Errorf("line %v: %v", line, err)
+		}
+
+		timelines[r.key()] = append(timelines[r.key()], r)
+	}
+
+	if err := scanner.Err(); err != nil {
+		return err
+	}
+
+	mergeUnknownPeers(timelines)
+	ids := []traceKey{}
+
+	for id, records := range timelines {
+		ids = append(ids, id)
+		sort.SliceStable(records, func(i, j int) bool {
+			return records[i].Time.Before(records[j].Time)
+		})
+	}
+
+	sort.Slice(ids, func(i, j int) bool {
+		return timelines[ids[i]][0].Time.Before(timelines[ids[j]][0].Time)
+	})
+
+	for _, id := range ids {
+		renderTimeline(out, id, timelines[id])
+	}
+
+	return nil
+}
+
+// Datagrams sent before the first reply have no peer yet.
+// They belong to the session with the same ID if it's unambiguous.
+func mergeUnknownPeers(timelines map[traceKey][]traceRecord) {
+	for key, records := range timelines {
+		if key.peer != 0 {
+			continue
+		}
+
+		matches := []traceKey{}
+
+		for other := range timelines {
+			if other.peer != 0 && other.tunnel == key.tunnel && other.session == key.session {
+				matches = append(matches, other)
+			}
+		}
+
+		if len(matches) == 1 {
+			timelines[matches[0]] = append(timelines[matches[0]], records...)
+			delete(timelines, key)
+		}
+	}
+}
+
+func renderTimeline(out io.Writer, key traceKey, records []traceRecord) {
+	sent, received, errs := 0, 0, 0
+	nums := map[string][]dgNum{}
+
+	for _, r := range records {
+		if r.Direction == traceDirectionSend {
+			sent++
+		} else {
+			received++
+		}
+
+		if len(r.Error) > 0 {
+			errs++
+		}
+
+		nums[r.Direction] = append(nums[r.Direction], r.Number)
+	}
+
+	fmt.Fprintf(out, "session %v  tunnel=%v peer=%v sent=%v received=%v errors=%v\n", key.session, key.tunnel, key.peer, sent, received, errs)
+
+	start := records[0].Time
+
+	for _, r := range records {
+		source := r.Method
+
+		if r.Direction == traceDirectionReceive {
+			source = r.Type
+		}
+
+		fmt.Fprintf(out, "  %v  +%-8v %v  %-14v club=%v  %v", r.Time.Format("15:04:05.000"), r.Time.Sub(start).Truncate(time.Millisecond), r.Direction, source, r.Club, r.datagram())
+
+		if r.Direction == traceDirectionSend {
+			fmt.Fprintf(out, "  %vms", r.Duration)
+		}
+
+		if len(r.Error) > 0 {
+			fmt.Fprintf(out, "  err=%v", r.Error)
+		}
+
+		fmt.Fprintln(out)
+	}
+
+	for _, direction := range []string{traceDirectionSend, traceDirectionReceive} {
+		if missing := missingNumbers(nums[direction]); len(missing) > 0 {
+			fmt.Fprintf(out, "  missing %v: %v\n", direction, missing)
+		}
+	}
+
+	fmt.Fprintln(out)
+}
+
+func missingNumbers(nums []dgNum) []dgNum {
+	if len(nums) == 0 {
+		return nil
+	}
+
+	missing := []dgNum{}
+	last := slices.Max(nums)
+
+	for num := dgNum(1); num < last; num++ {
+		if !slices.Contains(nums, num) {
+			missing = append(missing, num)
+		}
+	}
+
+	return missing
+}
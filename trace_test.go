@@ -0,0 +1,57 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestReplayTraceTimelines(t *testing.T) {
+	now := time.Now()
+	record := func(dir string, tunnel string, peer dgDev, ver dgVer, ses dgSes) traceRecord {
+		now = now.Add(time.Millisecond)
+
+		return traceRecord{Time: now, Direction: dir, Tunnel: tunnel, Peer: peer, Version: ver, Session: ses, Number: 1}
+	}
+	records := []traceRecord{
+		record(traceDirectionSend, "a", 0, datagramVersion, 1),
+		record(traceDirectionReceive, "a", 7, datagramVersion, -1),
+		record(traceDirectionSend, "b", 8, datagramVersion, 1),
+		record(traceDirectionReceive, "b", 9, 1, 1),
+	}
+
+	buf := &bytes.Buffer{}
+	enc := json.NewEncoder(buf)
+
+	for _, r := range records {
+		enc.Encode(r)
+	}
+
+	path := filepath.Join(t.TempDir(), "trace.jsonl")
+
+	if err := os.WriteFile(path, buf.Bytes(), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	out := &bytes.Buffer{}
+
+	if err := replayTrace(path, out); err != nil {
+		t.Fatal(err)
+	}
+
+	want := []string{
+		"session 1  tunnel=a peer=7 sent=1 received=1 errors=0",
+		"session 1  tunnel=b peer=8 sent=1 received=0 errors=0",
+		"session 1  tunnel=b peer=9 sent=0 received=1 errors=0",
+	}
+
+	for _, line := range want {
+		if !strings.Contains(out.String(), line) {
+			t.Fatalf("%q is missing in:\n%v", line, out)
+		}
+	}
+}
@@ -0,0 +1,94 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net"
+)
+
+const (
+	transparentModeRedirect = "redirect"
+	transparentModeTProxy   = "tproxy"
+)
+
+var errNotRedirected = errors.New("connection is not redirected")
+
+func listenTransparent(ctx context.Context, t *tunnel, cfg config) error {
+	addr := address{cfg.Transparent.Host, cfg.Transparent.Port}.String()
+	lc, err := transparentListenConfig(cfg.Transparent)
+
+	if err != nil {
+		return err
+	}
+
+	ln, err := lc.Listen(ctx, "tcp", addr)
+
+	if err != nil {
+		return err
+	}
+
+	go func() {
+		<-ctx.Done()
+		ln.Close()
+	}()
+
+	t.logger().Info("transparent: listening", "addr", addr, "mode", cfg.Transparent.Mode)
+
+	for {
+		conn, err := ln.Accept()
+
+		if err != nil {
+			if ctx.Err() != nil {
+				return nil
+			}
+
+			t.logger().Error("transparent: accept", "err", err)
+			continue
+		}
+
+		dst, err := transparentDestination(cfg.Transparent, conn)
+
+		if err != nil {
+			t.logger().Error("transparent: destination", "peer", conn.RemoteAddr().String(), "err", err)
+			conn.Close()
+			continue
+		}
+
+		ses, err := openSession(t, t.nextSessionID())
+
+		if err != nil {
+			t.logger().Error("transparent: session", "err", err)
+			conn.Close()
+			continue
+		}
+
+		ses.setPeer(conn)
+		t.setSession(ses.id, ses)
+
+		go acceptTarget(cfg, ses, dst, commandConnect)
+	}
+}
+
+func transparentDestination(cfg configTransparent, conn net.Conn) (address, error) {
+	local, ok := conn.LocalAddr().(*net.TCPAddr)
+
+	if !ok {
+		return address{}, errUnsupported
+	}
+
+	if cfg.Mode == transparentModeTProxy {
+		return address{local.IP.String(), uint16(local.Port)}, nil
+	}
+
+	dst, err := originalDestination(conn)
+
+	if err != nil {
+		return address{}, err
+	}
+
+	if dst.port == uint16(local.Port) && net.ParseIP(dst.host).Equal(local.IP) {
+		return address{}, errNotRedirected
+	}
+
+	return dst, nil
+}
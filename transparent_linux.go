@@ -0,0 +1,101 @@
+package main
+
+import (
+	"encoding/binary"
+	"net"
+	"syscall"
+)
+
+const (
+	soOriginalDst   = 80
+	ipv6Transparent = 75
+	ip6tOriginalDst = 80
+)
+
+func transparentListenConfig(cfg configTransparent) (net.ListenConfig, error) {
+	lc := net.ListenConfig{}
+
+	if cfg.Mode != transparentModeTProxy {
+		return lc, nil
+	}
+
+	lc.Control = func(network, address string, c syscall.RawConn) error {
+		var sockErr error
+
+		err := c.Control(func(fd uintptr) {
+			sockErr = syscall.SetsockoptInt(int(fd), syscall.SOL_IP, syscall.IP_TRANSPARENT, 1)
+
+			if sockErr == nil && network != "tcp4" {
+				// IPv4-only sockets reject the IPv6 option, it is fine to ignore.
+				syscall.SetsockoptInt(int(fd), syscall.SOL_IPV6, ipv6Transparent, 1)
+			}
+		})
+
+		if err != nil {
+			return err
+		}
+
+		return sockErr
+	}
+
+	return lc, nil
+}
+
+func originalDestination(conn net.Conn) (address, error) {
+	tcpConn, ok := conn.(*net.TCPConn)
+
+	if !ok {
+		return address{}, errUnsupported
+	}
+
+	raw, err := tcpConn.SyscallConn()
+
+	if err != nil {
+		return address{}, err
+	}
+
+	local := tcpConn.LocalAddr().(*net.TCPAddr)
+	dst := address{}
+	var sockErr error
+
+	err = raw.Control(func(fd uintptr) {
+		if local.IP.To4() != nil {
+			// sockaddr_in fits into ipv6_mreq, kernel copies only its size.
+			mreq, err := syscall.GetsockoptIPv6Mreq(int(fd), syscall.IPPROTO_IP, soOriginalDst)
+
+			if err != nil {
+				sockErr = err
+				return
+			}
+
+			dst.host = net.IP(mreq.Multiaddr[4:8]).String()
+			dst.port = binary.BigEndian.Uint16(mreq.Multiaddr[2:4])
+
+			return
+		}
+
+		// sockaddr_in6 fits into ip6_mtuinfo, kernel copies only its size.
+		info, err := syscall.GetsockoptIPv6MTUInfo(int(fd), syscall.IPPROTO_IPV6, ip6tOriginalDst)
+
+		if err != nil {
+			sockErr = err
+			return
+		}
+
+		port := make([]byte, 2)
+		binary.NativeEndian.PutUint16(port, info.Addr.Port)
+
+		dst.host = net.IP(info.Addr.Addr[:]).String()
+		dst.port = binary.BigEndian.Uint16(port)
+	})
+
+	if err != nil {
+		return address{}, err
+	}
+
+	if sockErr != nil {
+		return address{}, sockErr
+	}
+
+	return dst, nil
+}
@@ -0,0 +1,93 @@
+package main
+
+import (
+	"errors"
+	"net"
+	"os"
+	"os/exec"
+	"strconv"
+	"testing"
+)
+
+const testNetnsEnv = "VK_PROXY_TEST_NETNS"
+
+// REDIRECT rule is added in a new network namespace,
+// so the test reruns itself there with unshare.
+func TestTransparentRedirect(t *testing.T) {
+	if len(os.Getenv(testNetnsEnv)) == 0 {
+		if os.Geteuid() != 0 {
+			t.Skip("requires root")
+		}
+
+		for _, name := range []string{"unshare", "ip", "iptables"} {
+			if _, err := exec.LookPath(name); err != nil {
+				t.Skipf("%v is not found", name)
+			}
+		}
+
+		cmd := exec.Command("unshare", "--net", os.Args[0], "-test.run=^TestTransparentRedirect$")
+		cmd.Env = append(os.Environ(), testNetnsEnv+"=1")
+
+		if out, err := cmd.CombinedOutput(); err != nil {
+			t.Fatalf("%v\n%s", err, out)
+		}
+
+		return
+	}
+
+	runCommand(t, "ip", "link", "set", "lo", "up")
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer ln.Close()
+
+	port := strconv.Itoa(ln.Addr().(*net.TCPAddr).Port)
+	runCommand(t, "iptables", "-t", "nat", "-A", "OUTPUT", "-p", "tcp", "-d", "127.0.0.2", "--dport", "8080", "-j", "REDIRECT", "--to-ports", port)
+
+	cfg := configTransparent{Mode: transparentModeRedirect}
+
+	tests := []struct {
+		dial string
+		want address
+		err  error
+	}{
+		{"127.0.0.2:8080", address{"127.0.0.2", 8080}, nil},
+		{ln.Addr().String(), address{}, errNotRedirected},
+	}
+
+	for _, tt := range tests {
+		client, err := net.Dial("tcp", tt.dial)
+
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		conn, err := ln.Accept()
+
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		got, err := transparentDestination(cfg, conn)
+		client.Close()
+		conn.Close()
+
+		if !errors.Is(err, tt.err) {
+			t.Fatalf("%v: got error %v, want %v", tt.dial, err, tt.err)
+		}
+
+		if got != tt.want {
+			t.Fatalf("%v: got %v, want %v", tt.dial, got, tt.want)
+		}
+	}
+}
+
+func runCommand(t *testing.T, name string, args ...string) {
+	if out, err := exec.Command(name, args...).CombinedOutput(); err != nil {
+		t.Fatalf("%v: %v\n%s", name, err, out)
+	}
+}
@@ -0,0 +1,18 @@
+//go:build !linux
+
+package main
+
+import (
+	"errors"
+	"net"
+)
+
+var errTransparentUnsupported = errors.New("transparent proxy is supported only on linux")
+
+func transparentListenConfig(cfg configTransparent) (net.ListenConfig, error) {
+	return net.ListenConfig{}, errTransparentUnsupported
+}
+
+func originalDestination(conn net.Conn) (address, error) {
+	return address{}, errTransparentUnsupported
+}
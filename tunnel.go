@@ -0,0 +1,371 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"strings"
+	"sync"
+	"sync/atomic"
+)
+
+// Sections that are shared by all tunnels of the process.
+var processSections = []string{"log", "dns", "metrics", "admin", "trace", "tunnels"}
+
+// Each tunnel has own device ID, so datagrams and storage namespace
+// don't depend on other tunnels. Metrics, trace and payload log are
+// shared by the process, their labels and records carry tunnel name
+// instead. Uptime is process wide.
+type tunnel struct {
+	name        string
+	device      dgDev
+	state       atomic.Pointer[tunnelState]
+	keys        atomic.Pointer[keyRing]
+	keysMu      sync.Mutex
+	sessions    map[dgSes]*session
+	sessionsMu  sync.Mutex
+	sessionID   dgSes
+	sessionIDMu sync.Mutex
+	queues      map[dgSes]*handlerPriorityQueue
+	queuesMu    sync.Mutex
+	storage     storageState
+	dnsCache    map[string]dnsCacheEntry
+	dnsCacheMu  sync.Mutex
+	reloaded    chan struct{}
+}
+
+// All tunnels of the process. Set once on startup.
+var tunnels []*tunnel
+
+func newTunnel(name string) *tunnel {
+	return &tunnel{
+		name:     name,
+		device:   newDeviceID(),
+		sessions: map[dgSes]*session{},
+		queues:   map[dgSes]*handlerPriorityQueue{},
+		storage: storageState{
+			namespace: storageNamespaceUnknown,
+		},
+		dnsCache: map[string]dnsCacheEntry{},
+		reloaded: make(chan struct{}, 1),
+	}
+}
+
+func findTunnel(name string) (*tunnel, bool) {
+	for _, t := range tunnels {
+		if t.name == name {
+			return t, true
+		}
+	}
+
+	return nil, false
+}
+
+func forEachTunnelSession(f func(ses *session)) {
+	for _, t := range tunnels {
+		t.forEachSession(f)
+	}
+}
+
+// Config and methods derived from it are swapped together,
+// so readers never see one without the other.
+type tunnelState struct {
+	config  config
+	methods *methodSettings
+}
+
+func (t *tunnel) storeConfig(cfg config) {
+	t.state.Store(&tunnelState{
+		config:  cfg,
+		methods: newMethodSettings(cfg),
+	})
+	t.storeKeys(cfg.Session)
+}
+
+func (t *tunnel) loadConfig() config {
+	return t.state.Load().config
+}
+
+func (t *tunnel) loadMethods() *methodSettings {
+	return t.state.Load().methods
+}
+
+func (t *tunnel) logger() *slog.Logger {
+	if len(t.name) == 0 {
+		return slog.Default()
+	}
+
+	return slog.With("tunnel", t.name)
+}
+
+func (t *tunnel) wrapError(err error) error {
+	return tunnelError(t.name, err)
+}
+
+func tunnelError(name string, err error) error {
+	if len(name) == 0 {
+		return err
+	}
+
+	return fmt.Errorf("tunnel %v: %v", name, err)
+}
+
+// Sections set in tunnel are merged into top level ones,
+// so tunnel inherits everything it doesn't set.
+func parseTunnelConfig(name string, data []byte, overrides map[string]json.RawMessage) (configTunnel, error) {
+	tc := configTunnel{}
+
+	if raw, exists := overrides["name"]; exists {
+		if err := json.Unmarshal(raw, &tc.Name); err != nil {
+			return configTunnel{}, fmt.Errorf("name: %v", err)
+		}
+	}
+
+	tc.Config = defaultConfig()
+
+	if err := json.Unmarshal(data, &tc.Config); err != nil {
+		return configTunnel{}, err
+	}
+
+	tc.Config.Tunnels = nil
+	merged, err := json.Marshal(overrides)
+
+	if err != nil {
+		return configTunnel{}, err
+	}
+
+	if err := json.Unmarshal(merged, &tc.Config); err != nil {
+		return configTunnel{}, err
+	}
+
+	tc.Config.Tunnels = nil
+
+	if _, exists := overrides["secrets"]; !exists {
+		tc.Config.SharedSecrets = true
+	}
+
+	if err := prepareConfig(&tc.Config, name); err != nil {
+		return configTunnel{}, err
+	}
+
+	// Health and disabled state of clubs and users are kept per tunnel.
+	for i := range tc.Config.Clubs {
+		tc.Config.Clubs[i].Tunnel = tc.Name
+	}
+
+	for i := range tc.Config.Users {
+		tc.Config.Users[i].Tunnel = tc.Name
+	}
+
+	return tc, nil
+}
+
+// Problems in sections inherited from top level are reported
+// once and without tunnel prefix.
+func tunnelPath(cfg config, i int, path string) string {
+	if len(cfg.Tunnels) == 0 {
+		return path
+	}
+
+	section := path
+
+	if j := strings.IndexAny(path, ".["); j >= 0 {
+		section = path[:j]
+	}
+
+	if _, exists := cfg.Tunnels[i][section]; !exists {
+		return path
+	}
+
+	return fmt.Sprintf("tunnels[%v].%v", i, path)
+}
+
+func (c *configChecker) addTunnelProblems(cfg config, i int, problems []error, seen map[string]bool) {
+	for _, err := range problems {
+		var problem configProblem
+
+		if !errors.As(err, &problem) {
+			c.problems = append(c.problems, err)
+			continue
+		}
+
+		problem.path = tunnelPath(cfg, i, problem.path)
+
+		if !seen[problem.Error()] {
+			seen[problem.Error()] = true
+			c.problems = append(c.problems, problem)
+		}
+	}
+}
+
+func checkTunnels(cfg config) []error {
+	c := &configChecker{}
+	seen := map[string]bool{}
+	names := map[string]bool{}
+	listeners := map[string]string{}
+	clubs := map[string]string{}
+
+	for i, tc := range cfg.TunnelConfigs {
+		path := fmt.Sprintf("tunnels[%v]", i)
+
+		if c.required(path+".name", tc.Name) {
+			if names[tc.Name] {
+				c.add(path+".name", "is duplicated: %v", tc.Name)
+			}
+
+			names[tc.Name] = true
+		}
+
+		for _, section := range processSections {
+			if _, exists := cfg.Tunnels[i][section]; exists {
+				c.add(path+"."+section, "can be set only at top level")
+			}
+		}
+
+		c.addTunnelProblems(cfg, i, checkTunnelConfig(tc.Config), seen)
+
+		label := tc.Name
+
+		if len(label) == 0 {
+			label = path
+		}
+
+		for _, l := range tunnelListeners(tc.Config) {
+			if other, exists := listeners[l.addr]; exists && other != label {
+				c.add(tunnelPath(cfg, i, l.path), "address %v is already used by tunnel %v", l.addr, other)
+				continue
+			}
+
+			listeners[l.addr] = label
+		}
+
+		for j, club := range tc.Config.Clubs {
+			if other, exists := clubs[club.ID]; exists && other != label {
+				c.add(tunnelPath(cfg, i, fmt.Sprintf("clubs[%v].id", j)), "is already used by tunnel %v", other)
+				continue
+			}
+
+			clubs[club.ID] = label
+		}
+	}
+
+	return c.problems
+}
+
+type tunnelListener struct {
+	path string
+	addr string
+}
+
+func tunnelListeners(cfg config) []tunnelListener {
+	listeners := []tunnelListener{
+		{"socks.port", address{cfg.Socks.Host, cfg.Socks.Port}.String()},
+	}
+
+	if cfg.DNSServer.Port != 0 {
+		listeners = append(listeners, tunnelListener{"dnsServer.port", address{cfg.DNSServer.Host, cfg.DNSServer.Port}.String()})
+	}
+
+	if cfg.Transparent.Port != 0 {
+		listeners = append(listeners, tunnelListener{"transparent.port", address{cfg.Transparent.Host, cfg.Transparent.Port}.String()})
+	}
+
+	for i, fwd := range cfg.Forwards {
+		if len(fwd.Listen) == 0 {
+			continue
+		}
+
+		listeners = append(listeners, tunnelListener{fmt.Sprintf("forwards[%v].listen", i), fwd.Listen})
+	}
+
+	return listeners
+}
+
+func validateTunnel(cfg config) error {
+	if err := validateQR(cfg.QR); err != nil {
+		return fmt.Errorf("validate qr: %v", err)
+	}
+
+	for _, club := range cfg.Clubs {
+		if err := validateClub(cfg.API, club); err != nil {
+			return fmt.Errorf("validate club: %v: %v", club.Name, err)
+		}
+
+		if err := validateLongPoll(cfg.API, club); err != nil {
+			return fmt.Errorf("validate long poll: %v: %v", club.Name, err)
+		}
+	}
+
+	for _, user := range cfg.Users {
+		if err := validateUser(cfg.API, user); err != nil {
+			return fmt.Errorf("validate user: %v: %v", user.Name, err)
+		}
+	}
+
+	return nil
+}
+
+func runTunnel(ctx context.Context, t *tunnel, errs chan<- error) {
+	cfg := t.loadConfig()
+
+	var wg sync.WaitGroup
+
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+
+		if err := listenSocks(ctx, t, cfg); err != nil {
+			errs <- t.wrapError(fmt.Errorf("listen socks: %v", err))
+		}
+	}()
+
+	if cfg.DNSServer.Port != 0 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+
+			if err := listenDNS(ctx, t, cfg); err != nil {
+				errs <- t.wrapError(fmt.Errorf("listen dns: %v", err))
+			}
+		}()
+	}
+
+	if cfg.Transparent.Port != 0 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+
+			if err := listenTransparent(ctx, t, cfg); err != nil {
+				errs <- t.wrapError(fmt.Errorf("listen transparent: %v", err))
+			}
+		}()
+	}
+
+	for _, fwd := range cfg.Forwards {
+		if len(fwd.Listen) == 0 {
+			continue
+		}
+
+		wg.Add(1)
+		go func(fwd configForward) {
+			defer wg.Done()
+
+			if err := listenForward(ctx, t, cfg, fwd); err != nil {
+				errs <- t.wrapError(fmt.Errorf("listen forward: %v: %v", fwd.Listen, err))
+			}
+		}(fwd)
+	}
+
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+
+		if err := superviseClubs(ctx, t, errs); err != nil {
+			errs <- t.wrapError(fmt.Errorf("supervise clubs: %v", err))
+		}
+	}()
+
+	wg.Wait()
+}
@@ -0,0 +1,66 @@
+package main
+
+import (
+	"bytes"
+	"maps"
+	"testing"
+
+	"github.com/srgykuz/vk-proxy/vktest"
+)
+
+func TestTunnels(t *testing.T) {
+	if testing.Short() {
+		t.Skip("skipping in short mode")
+	}
+
+	vk := vktest.NewServer()
+	t.Cleanup(vk.Close)
+
+	vk.AddClub("100", "token100")
+	vk.AddClub("101", "token101")
+	vk.AddUser("200", "token200")
+
+	target, body := startTarget(t)
+	secrets := [2]string{testSecret(t), testSecret(t)}
+	ports := [2][2]int{}
+
+	for i := range ports {
+		for j := range ports[i] {
+			ports[i][j] = freePort(t)
+		}
+
+		cfg := testConfig(vk)
+		maps.Copy(cfg, map[string]any{
+			"tunnels": []any{
+				map[string]any{
+					"name":    "a",
+					"session": map[string]any{"secret": secrets[0]},
+					"socks":   map[string]any{"port": ports[i][0]},
+					"clubs":   []any{testClub("a", "100", "token100")},
+				},
+				map[string]any{
+					"name":    "b",
+					"session": map[string]any{"secret": secrets[1]},
+					"socks":   map[string]any{"port": ports[i][1]},
+					"clubs":   []any{testClub("b", "101", "token101")},
+				},
+			},
+		})
+		startProxy(t, writeTestConfig(t, cfg))
+		waitCalls(t, vk, "groups.getLongPollServer", 2*(i+1))
+	}
+
+	for i := range ports {
+		for j, port := range ports[i] {
+			got, err := fetchSocks(port, target.URL)
+
+			if err != nil {
+				t.Fatalf("proxy %v, tunnel %v: %v", i, j, err)
+			}
+
+			if !bytes.Equal(got, body) {
+				t.Fatalf("proxy %v, tunnel %v: got %v bytes, want %v", i, j, len(got), len(body))
+			}
+		}
+	}
+}
@@ -0,0 +1,270 @@
+package main
+
+import (
+	"bufio"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"time"
+)
+
+const (
+	upstreamTypeSocks5 = "socks5"
+	upstreamTypeHTTP   = "http"
+)
+
+type upstreamReplyError struct {
+	result byte
+}
+
+func (e upstreamReplyError) Error() string {
+	return fmt.Sprintf("upstream reply %v", e.result)
+}
+
+func matchUpstream(cfg configUpstream, addr address) string {
+	ip := net.ParseIP(addr.host)
+	host := addr.host
+
+	if ip != nil {
+		host = ""
+	}
+
+	return cfg.RuleSet.match(host, ip, addr.port)
+}
+
+// Proxies get the address as requested, so they resolve domains themselves.
+// Direct dial uses the address checked by ACL.
+func dialTarget(cfg configUpstream, name string, addr address, checked address, timeout time.Duration) (net.Conn, error) {
+	if name == ruleActionDirect {
+		return net.DialTimeout("tcp", checked.String(), timeout)
+	}
+
+	for _, proxy := range cfg.Proxies {
+		if proxy.Name != name {
+			continue
+		}
+
+		switch proxy.Type {
+		case upstreamTypeSocks5:
+			return dialUpstreamSocks5(proxy, addr, timeout)
+		case upstreamTypeHTTP:
+			return dialUpstreamHTTP(proxy, addr, timeout)
+		default:
+			return nil, fmt.Errorf("unknown upstream type: %v", proxy.Type)
+		}
+	}
+
+	return nil, fmt.Errorf("unknown upstream: %v", name)
+}
+
+func dialUpstreamSocks5(proxy configUpstreamProxy, addr address, timeout time.Duration) (net.Conn, error) {
+	conn, err := net.DialTimeout("tcp", proxy.Address, timeout)
+
+	if err != nil {
+		return nil, err
+	}
+
+	if err := handshakeUpstreamSocks5(conn, proxy, addr, timeout); err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("upstream %v: %w", proxy.Name, err)
+	}
+
+	return conn, nil
+}
+
+func handshakeUpstreamSocks5(conn net.Conn, proxy configUpstreamProxy, addr address, timeout time.Duration) error {
+	if len(proxy.Username) > 255 || len(proxy.Password) > 255 {
+		return errors.New("username or password is too long")
+	}
+
+	if net.ParseIP(addr.host) == nil && len(addr.host) > 255 {
+		return errors.New("domain is too long")
+	}
+
+	if err := conn.SetDeadline(time.Now().Add(timeout)); err != nil {
+		return err
+	}
+
+	methods := []byte{0x00}
+
+	if len(proxy.Username) > 0 {
+		methods = append(methods, 0x02)
+	}
+
+	out := []byte{0x05, byte(len(methods))}
+	out = append(out, methods...)
+
+	if _, err := conn.Write(out); err != nil {
+		return err
+	}
+
+	in := make([]byte, 2)
+
+	if _, err := io.ReadFull(conn, in); err != nil {
+		return err
+	}
+
+	if in[0] != 0x05 {
+		return errUnacceptable
+	}
+
+	switch in[1] {
+	case 0x00:
+	case 0x02:
+		out = []byte{0x01, byte(len(proxy.Username))}
+		out = append(out, proxy.Username...)
+		out = append(out, byte(len(proxy.Password)))
+		out = append(out, proxy.Password...)
+
+		if _, err := conn.Write(out); err != nil {
+			return err
+		}
+
+		if _, err := io.ReadFull(conn, in); err != nil {
+			return err
+		}
+
+		if in[1] != 0x00 {
+			return errors.New("authentication failed")
+		}
+	default:
+		return errUnsupported
+	}
+
+	out = []byte{0x05, 0x01, 0x00}
+	ip := net.ParseIP(addr.host)
+
+	if ip4 := ip.To4(); ip4 != nil {
+		out = append(out, 0x01)
+		out = append(out, ip4...)
+	} else if ip != nil {
+		out = append(out, 0x04)
+		out = append(out, ip...)
+	} else {
+		out = append(out, 0x03, byte(len(addr.host)))
+		out = append(out, addr.host...)
+	}
+
+	out = binary.BigEndian.AppendUint16(out, addr.port)
+
+	if _, err := conn.Write(out); err != nil {
+		return err
+	}
+
+	in = make([]byte, 4)
+
+	if _, err := io.ReadFull(conn, in); err != nil {
+		return err
+	}
+
+	if in[1] != 0x00 {
+		return upstreamReplyError{in[1]}
+	}
+
+	naddr := 0
+
+	switch in[3] {
+	case 0x01:
+		naddr = 4
+	case 0x04:
+		naddr = 16
+	case 0x03:
+		n := make([]byte, 1)
+
+		if _, err := io.ReadFull(conn, n); err != nil {
+			return err
+		}
+
+		naddr = int(n[0])
+	default:
+		return errUnsupported
+	}
+
+	if _, err := io.ReadFull(conn, make([]byte, naddr+2)); err != nil {
+		return err
+	}
+
+	return conn.SetDeadline(time.Time{})
+}
+
+type bufferedConn struct {
+	net.Conn
+	r *bufio.Reader
+}
+
+func (c bufferedConn) Read(b []byte) (int, error) {
+	return c.r.Read(b)
+}
+
+func dialUpstreamHTTP(proxy configUpstreamProxy, addr address, timeout time.Duration) (net.Conn, error) {
+	conn, err := net.DialTimeout("tcp", proxy.Address, timeout)
+
+	if err != nil {
+		return nil, err
+	}
+
+	r, err := handshakeUpstreamHTTP(conn, proxy, addr, timeout)
+
+	if err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("upstream %v: %w", proxy.Name, err)
+	}
+
+	if r.Buffered() > 0 {
+		return bufferedConn{conn, r}, nil
+	}
+
+	return conn, nil
+}
+
+func handshakeUpstreamHTTP(conn net.Conn, proxy configUpstreamProxy, addr address, timeout time.Duration) (*bufio.Reader, error) {
+	if err := conn.SetDeadline(time.Now().Add(timeout)); err != nil {
+		return nil, err
+	}
+
+	target := addr.String()
+	req := fmt.Sprintf("CONNECT %v HTTP/1.1\r\nHost: %v\r\n", target, target)
+
+	if len(proxy.Username) > 0 {
+		auth := base64.StdEncoding.EncodeToString([]byte(proxy.Username + ":" + proxy.Password))
+		req += fmt.Sprintf("Proxy-Authorization: Basic %v\r\n", auth)
+	}
+
+	req += "\r\n"
+
+	if _, err := io.WriteString(conn, req); err != nil {
+		return nil, err
+	}
+
+	r := bufio.NewReader(conn)
+	resp, err := http.ReadResponse(r, &http.Request{Method: http.MethodConnect})
+
+	if err != nil {
+		return nil, err
+	}
+
+	resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		switch resp.StatusCode {
+		case http.StatusForbidden, http.StatusProxyAuthRequired:
+			return nil, upstreamReplyError{connectResultNotAllowed}
+		case http.StatusBadGateway:
+			return nil, upstreamReplyError{connectResultHostUnreachable}
+		case http.StatusGatewayTimeout:
+			return nil, upstreamReplyError{connectResultTTLExpired}
+		default:
+			return nil, fmt.Errorf("HTTP %v", resp.StatusCode)
+		}
+	}
+
+	if err := conn.SetDeadline(time.Time{}); err != nil {
+		return nil, err
+	}
+
+	return r, nil
+}
@@ -0,0 +1,618 @@
+// Package vktest implements in memory the subset of VK API that vk-proxy uses.
+//
+// Point api.url of two proxy instances at Server.APIURL and register the same
+// clubs and users on both to wire them together without live VK tokens.
+// The server speaks TLS like VK does, so the proxies either use Server.Client
+// as the API client or set api.tls.insecure.
+package vktest
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Error codes returned by the server, matching VK API.
+const (
+	ErrorCodeAuth         = 5
+	ErrorCodeFloodControl = 9
+	ErrorCodeParam        = 100
+)
+
+// Server is a fake VK API server.
+type Server struct {
+	*httptest.Server
+
+	mu       sync.Mutex
+	nextID   int
+	clubs    map[string]*club
+	tokens   map[string]string
+	users    map[string]string
+	files    map[string][]byte
+	docs     map[int][]byte
+	photos   map[int][]byte
+	failures map[string]failure
+	calls    map[string]int
+}
+
+type failure struct {
+	code int
+	left int
+}
+
+type club struct {
+	id      string
+	storage map[string]string
+	events  []event
+	notify  chan struct{}
+}
+
+type event struct {
+	Type    string      `json:"type"`
+	EventID string      `json:"event_id"`
+	V       string      `json:"v"`
+	GroupID int         `json:"group_id"`
+	Object  eventObject `json:"object"`
+}
+
+type eventObject struct {
+	ID        int          `json:"id"`
+	Date      int          `json:"date"`
+	Text      string       `json:"text"`
+	OrigPhoto *eventPhoto  `json:"orig_photo,omitempty"`
+	Changes   *eventChange `json:"changes,omitempty"`
+}
+
+type eventPhoto struct {
+	URL string `json:"url"`
+}
+
+type eventChange struct {
+	Description *eventChangeString `json:"description,omitempty"`
+	Website     *eventChangeString `json:"website,omitempty"`
+}
+
+type eventChangeString struct {
+	OldValue string `json:"old_value"`
+	NewValue string `json:"new_value"`
+}
+
+// NewServer starts a fake VK API server. Callers should call Close when finished.
+func NewServer() *Server {
+	s := &Server{
+		clubs:    map[string]*club{},
+		tokens:   map[string]string{},
+		users:    map[string]string{},
+		files:    map[string][]byte{},
+		docs:     map[int][]byte{},
+		photos:   map[int][]byte{},
+		failures: map[string]failure{},
+		calls:    map[string]int{},
+	}
+
+	mux := http.NewServeMux()
+
+	mux.HandleFunc("/method/{method}", s.handleMethod)
+	mux.HandleFunc("POST /upload/doc", s.handleUploadDoc)
+	mux.HandleFunc("POST /upload/photo", s.handleUploadPhoto)
+	mux.HandleFunc("POST /upload/video", s.handleUploadVideo)
+	mux.HandleFunc("POST /upload/market", s.handleUploadMarket)
+	mux.HandleFunc("GET /doc/{id}", s.handleDownloadDoc)
+	mux.HandleFunc("GET /photo/{id}", s.handleDownloadPhoto)
+	mux.HandleFunc("GET /lp/{club}", s.handleLongPoll)
+
+	s.Server = httptest.NewTLSServer(mux)
+
+	return s
+}
+
+// APIURL returns the value for api.url.
+func (s *Server) APIURL() string {
+	return s.URL + "/method/"
+}
+
+// AddClub registers a club with its access token.
+func (s *Server) AddClub(id, token string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.clubs[id] = &club{
+		id:      id,
+		storage: map[string]string{},
+		notify:  make(chan struct{}),
+	}
+	s.tokens[token] = id
+}
+
+// AddUser registers a user with its access token.
+func (s *Server) AddUser(id, token string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.users[token] = id
+}
+
+// Fail makes the next n calls of method fail with the error code.
+func (s *Server) Fail(method string, code int, n int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if n <= 0 {
+		delete(s.failures, method)
+		return
+	}
+
+	s.failures[method] = failure{code: code, left: n}
+}
+
+// Calls returns how many times method was called.
+func (s *Server) Calls(method string) int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.calls[method]
+}
+
+func (s *Server) handleMethod(w http.ResponseWriter, r *http.Request) {
+	if err := r.ParseMultipartForm(32 << 20); err != nil && err != http.ErrNotMultipart {
+		writeError(w, ErrorCodeParam, err.Error())
+		return
+	}
+
+	method := r.PathValue("method")
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.calls[method]++
+
+	if f, exists := s.failures[method]; exists {
+		f.left--
+
+		if f.left > 0 {
+			s.failures[method] = f
+		} else {
+			delete(s.failures, method)
+		}
+
+		writeError(w, f.code, "injected failure")
+		return
+	}
+
+	token := r.FormValue("access_token")
+	clubID, isClub := s.tokens[token]
+	_, isUser := s.users[token]
+
+	if !isClub && !isUser {
+		writeError(w, ErrorCodeAuth, "User authorization failed: invalid access_token")
+		return
+	}
+
+	if !isClub {
+		clubID = strings.TrimPrefix(r.FormValue("owner_id"), "-")
+
+		if clubID == "" {
+			clubID = r.FormValue("group_id")
+		}
+	}
+
+	c := s.clubs[clubID]
+
+	switch method {
+	case "groups.getTokenPermissions":
+		writeResponse(w, map[string]int{"mask": 1<<30 - 1})
+		return
+	case "account.getAppPermissions":
+		writeResponse(w, 1<<30-1)
+		return
+	}
+
+	if c == nil {
+		writeError(w, ErrorCodeParam, "One of the parameters specified was missing or invalid: group_id")
+		return
+	}
+
+	switch method {
+	case "messages.send":
+		id := s.addEvent(c, "message_reply", r.FormValue("message"))
+		writeResponse(w, id)
+	case "wall.post":
+		id := s.addEvent(c, "wall_post_new", r.FormValue("message"))
+		writeResponse(w, map[string]int{"post_id": id})
+	case "wall.createComment":
+		id := s.addEvent(c, "wall_reply_new", r.FormValue("message"))
+		writeResponse(w, map[string]int{"comment_id": id})
+	case "video.createComment":
+		writeResponse(w, s.addEvent(c, "video_comment_new", r.FormValue("message")))
+	case "photos.createComment":
+		writeResponse(w, s.addEvent(c, "photo_comment_new", r.FormValue("message")))
+	case "market.createComment":
+		writeResponse(w, s.addEvent(c, "market_comment_new", r.FormValue("message")))
+	case "board.addTopic":
+		writeResponse(w, s.addEvent(c, "board_post_new", r.FormValue("text")))
+	case "board.createComment":
+		writeResponse(w, s.addEvent(c, "board_post_new", r.FormValue("message")))
+	case "groups.edit":
+		s.handleGroupsEdit(w, r, c)
+	case "docs.getWallUploadServer":
+		writeResponse(w, map[string]string{"upload_url": s.URL + "/upload/doc"})
+	case "docs.save":
+		s.handleDocsSave(w, r)
+	case "photos.getUploadServer":
+		writeResponse(w, map[string]string{"upload_url": s.URL + "/upload/photo"})
+	case "photos.save":
+		s.handlePhotosSave(w, r, c)
+	case "storage.get":
+		s.handleStorageGet(w, r, c)
+	case "storage.set":
+		c.storage[r.FormValue("key")] = r.FormValue("value")
+		writeResponse(w, 1)
+	case "groups.getLongPollServer":
+		server := map[string]string{
+			"key":    "key-" + c.id,
+			"server": s.URL + "/lp/" + c.id,
+			"ts":     strconv.Itoa(len(c.events)),
+		}
+		writeResponse(w, server)
+	case "groups.getLongPollSettings":
+		s.handleGroupsGetLongPollSettings(w)
+	case "groups.setLongPollSettings":
+		writeResponse(w, 1)
+	case "photos.createAlbum":
+		s.nextID++
+		writeResponse(w, map[string]int{"id": s.nextID})
+	case "video.save":
+		s.nextID++
+		video := map[string]any{
+			"upload_url": s.URL + "/upload/video",
+			"video_id":   s.nextID,
+			"owner_id":   "-" + c.id,
+		}
+		writeResponse(w, video)
+	case "photos.getMarketUploadServer":
+		writeResponse(w, map[string]string{"upload_url": s.URL + "/upload/market"})
+	case "photos.saveMarketPhoto":
+		s.handlePhotosSaveMarketPhoto(w, r)
+	case "market.add":
+		s.nextID++
+		writeResponse(w, map[string]int{"market_item_id": s.nextID})
+	default:
+		writeError(w, 3, "Unknown method passed")
+	}
+}
+
+func (s *Server) handleGroupsEdit(w http.ResponseWriter, r *http.Request, c *club) {
+	changes := &eventChange{}
+
+	if description := r.FormValue("description"); description != "" {
+		changes.Description = &eventChangeString{NewValue: description}
+	}
+
+	if website := r.FormValue("website"); website != "" {
+		changes.Website = &eventChangeString{NewValue: website}
+	}
+
+	s.addEventObject(c, "group_change_settings", eventObject{Changes: changes})
+	writeResponse(w, 1)
+}
+
+func (s *Server) handleDocsSave(w http.ResponseWriter, r *http.Request) {
+	data, exists := s.files[r.FormValue("file")]
+
+	if !exists {
+		writeError(w, ErrorCodeParam, "One of the parameters specified was missing or invalid: file")
+		return
+	}
+
+	delete(s.files, r.FormValue("file"))
+
+	s.nextID++
+	id := s.nextID
+	s.docs[id] = data
+
+	doc := map[string]any{
+		"type": "doc",
+		"doc": map[string]any{
+			"id":   id,
+			"size": len(data),
+			"url":  fmt.Sprintf("%v/doc/%v", s.URL, id),
+		},
+	}
+	writeResponse(w, doc)
+}
+
+func (s *Server) handlePhotosSave(w http.ResponseWriter, r *http.Request, c *club) {
+	data, exists := s.files[r.FormValue("photos_list")]
+
+	if !exists {
+		writeError(w, ErrorCodeParam, "One of the parameters specified was missing or invalid: photos_list")
+		return
+	}
+
+	delete(s.files, r.FormValue("photos_list"))
+
+	s.nextID++
+	id := s.nextID
+	s.photos[id] = data
+
+	obj := eventObject{
+		ID:   id,
+		Text: r.FormValue("caption"),
+		OrigPhoto: &eventPhoto{
+			URL: fmt.Sprintf("%v/photo/%v", s.URL, id),
+		},
+	}
+	s.addEventObject(c, "photo_new", obj)
+	writeResponse(w, []map[string]int{{"id": id}})
+}
+
+func (s *Server) handlePhotosSaveMarketPhoto(w http.ResponseWriter, r *http.Request) {
+	data, exists := s.files[r.FormValue("photo")]
+
+	if !exists {
+		writeError(w, ErrorCodeParam, "One of the parameters specified was missing or invalid: photo")
+		return
+	}
+
+	delete(s.files, r.FormValue("photo"))
+
+	s.nextID++
+	id := s.nextID
+	s.photos[id] = data
+
+	writeResponse(w, []map[string]int{{"id": id}})
+}
+
+func (s *Server) handleStorageGet(w http.ResponseWriter, r *http.Request, c *club) {
+	values := []map[string]string{}
+
+	for _, key := range strings.Split(r.FormValue("keys"), ",") {
+		values = append(values, map[string]string{
+			"key":   key,
+			"value": c.storage[key],
+		})
+	}
+
+	writeResponse(w, values)
+}
+
+func (s *Server) handleGroupsGetLongPollSettings(w http.ResponseWriter) {
+	events := map[string]int{}
+	types := []string{
+		"message_reply",
+		"photo_new",
+		"photo_comment_new",
+		"video_comment_new",
+		"wall_post_new",
+		"wall_reply_new",
+		"group_change_settings",
+		"market_comment_new",
+		"board_post_new",
+	}
+
+	for _, t := range types {
+		events[t] = 1
+	}
+
+	settings := map[string]any{
+		"is_enabled": true,
+		"events":     events,
+	}
+	writeResponse(w, settings)
+}
+
+func (s *Server) handleUploadDoc(w http.ResponseWriter, r *http.Request) {
+	data, err := readUpload(r, "file")
+
+	if err != nil {
+		writeJSON(w, map[string]string{"error": "no_file", "error_descr": err.Error()})
+		return
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.nextID++
+	file := fmt.Sprintf("doc-%v", s.nextID)
+	s.files[file] = data
+
+	writeJSON(w, map[string]string{"file": file})
+}
+
+func (s *Server) handleUploadPhoto(w http.ResponseWriter, r *http.Request) {
+	data, err := readUpload(r, "file1")
+
+	if err != nil {
+		writeJSON(w, map[string]any{"server": 1, "photos_list": "[]", "hash": ""})
+		return
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.nextID++
+	list := fmt.Sprintf("photo-%v", s.nextID)
+	s.files[list] = data
+
+	writeJSON(w, map[string]any{"server": 1, "photos_list": list, "hash": "hash"})
+}
+
+func (s *Server) handleUploadVideo(w http.ResponseWriter, r *http.Request) {
+	data, err := readUpload(r, "video_file")
+
+	if err != nil {
+		writeJSON(w, map[string]string{"error": "no_file", "error_descr": err.Error()})
+		return
+	}
+
+	writeJSON(w, map[string]int{"size": len(data)})
+}
+
+func (s *Server) handleUploadMarket(w http.ResponseWriter, r *http.Request) {
+	data, err := readUpload(r, "file")
+
+	if err != nil {
+		writeJSON(w, map[string]string{"error": "no_file", "error_descr": err.Error()})
+		return
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.nextID++
+	photo := fmt.Sprintf("market-%v", s.nextID)
+	s.files[photo] = data
+
+	writeJSON(w, map[string]any{"server": 1, "photo": photo, "hash": "hash", "crop_data": "", "crop_hash": ""})
+}
+
+func (s *Server) handleDownloadDoc(w http.ResponseWriter, r *http.Request) {
+	s.handleDownload(w, r, s.docs, "text/plain")
+}
+
+func (s *Server) handleDownloadPhoto(w http.ResponseWriter, r *http.Request) {
+	s.handleDownload(w, r, s.photos, "image/png")
+}
+
+func (s *Server) handleDownload(w http.ResponseWriter, r *http.Request, files map[int][]byte, contentType string) {
+	id, err := strconv.Atoi(r.PathValue("id"))
+
+	if err != nil {
+		http.NotFound(w, r)
+		return
+	}
+
+	s.mu.Lock()
+	data, exists := files[id]
+	s.mu.Unlock()
+
+	if !exists {
+		http.NotFound(w, r)
+		return
+	}
+
+	w.Header().Set("Content-Type", contentType)
+	w.Write(data)
+}
+
+func (s *Server) handleLongPoll(w http.ResponseWriter, r *http.Request) {
+	s.mu.Lock()
+	c := s.clubs[r.PathValue("club")]
+	s.mu.Unlock()
+
+	if c == nil || r.FormValue("key") != "key-"+c.id {
+		writeJSON(w, map[string]int{"failed": 2})
+		return
+	}
+
+	ts, err := strconv.Atoi(r.FormValue("ts"))
+
+	if err != nil {
+		writeJSON(w, map[string]int{"failed": 1})
+		return
+	}
+
+	wait, _ := strconv.Atoi(r.FormValue("wait"))
+	deadline := time.After(time.Duration(wait) * time.Second)
+
+	for {
+		s.mu.Lock()
+		events := c.events
+		notify := c.notify
+		s.mu.Unlock()
+
+		if ts > len(events) {
+			writeJSON(w, map[string]any{"failed": 1, "ts": strconv.Itoa(len(events))})
+			return
+		}
+
+		if ts < len(events) {
+			resp := map[string]any{
+				"ts":      strconv.Itoa(len(events)),
+				"updates": events[ts:],
+			}
+			writeJSON(w, resp)
+			return
+		}
+
+		select {
+		case <-notify:
+		case <-deadline:
+			writeJSON(w, map[string]any{"ts": strconv.Itoa(ts), "updates": []event{}})
+			return
+		case <-r.Context().Done():
+			return
+		}
+	}
+}
+
+func (s *Server) addEvent(c *club, eventType string, text string) int {
+	s.nextID++
+
+	obj := eventObject{
+		ID:   s.nextID,
+		Text: text,
+	}
+
+	return s.addEventObject(c, eventType, obj)
+}
+
+func (s *Server) addEventObject(c *club, eventType string, obj eventObject) int {
+	if obj.ID == 0 {
+		s.nextID++
+		obj.ID = s.nextID
+	}
+
+	groupID, _ := strconv.Atoi(c.id)
+	obj.Date = int(time.Now().Unix())
+
+	c.events = append(c.events, event{
+		Type:    eventType,
+		EventID: strconv.Itoa(obj.ID),
+		V:       "5.199",
+		GroupID: groupID,
+		Object:  obj,
+	})
+
+	close(c.notify)
+	c.notify = make(chan struct{})
+
+	return obj.ID
+}
+
+func readUpload(r *http.Request, field string) ([]byte, error) {
+	file, _, err := r.FormFile(field)
+
+	if err != nil {
+		return nil, err
+	}
+
+	defer file.Close()
+
+	return io.ReadAll(file)
+}
+
+func writeResponse(w http.ResponseWriter, response any) {
+	writeJSON(w, map[string]any{"response": response})
+}
+
+func writeError(w http.ResponseWriter, code int, msg string) {
+	resp := map[string]any{
+		"error": map[string]any{
+			"error_code": code,
+			"error_msg":  msg,
+		},
+	}
+	writeJSON(w, resp)
+}
+
+func writeJSON(w http.ResponseWriter, v any) {
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	json.NewEncoder(w).Encode(v)
+}